@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"matek-video-streamer/internal/server"
+	"net"
+	"net/http"
+	"time"
+)
+
+// API is a HTTP server that exposes the state of the streamer
+type API struct {
+	Address string
+	Handler *server.ServerHandler
+
+	httpServer *http.Server
+}
+
+func (a *API) Initialize() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/sessions", a.onSessionsList)
+	mux.HandleFunc("GET /api/sessions/{id}", a.onSessionsGet)
+
+	ln, err := net.Listen("tcp", a.Address)
+	if err != nil {
+		return err
+	}
+
+	a.httpServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go a.httpServer.Serve(ln)
+
+	log.Printf("API is ready on %s", a.Address)
+
+	return nil
+}
+
+func (a *API) Close() {
+	a.httpServer.Close()
+}
+
+func (a *API) onSessionsList(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items": a.Handler.Sessions(),
+	})
+}
+
+func (a *API) onSessionsGet(w http.ResponseWriter, r *http.Request) {
+	info, ok := a.Handler.Session(r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{
+			"error": "session not found",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("failed to write API response: %v", err)
+	}
+}
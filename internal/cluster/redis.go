@@ -0,0 +1,203 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNil is returned when Redis replies with a nil value
+var errNil = errors.New("redis: nil")
+
+// redisClient is a minimal Redis client that speaks the RESP protocol
+// over a single connection, which is reopened after any failure.
+type redisClient struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	// dial opens a connection to the server. When nil, a TCP connection is opened to address.
+	dial func() (net.Conn, error)
+
+	mutex sync.Mutex
+	conn  net.Conn
+	br    *bufio.Reader
+}
+
+func (c *redisClient) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// do sends a command and returns its reply
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		err := c.connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := c.roundTrip(args)
+	if err != nil {
+		// the connection state is unknown after a network error
+		var redisErr redisError
+		if !errors.As(err, &redisErr) && !errors.Is(err, errNil) {
+			c.conn.Close()
+			c.conn = nil
+		}
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (c *redisClient) connect() error {
+	var conn net.Conn
+	var err error
+	if c.dial != nil {
+		conn, err = c.dial()
+	} else {
+		conn, err = net.DialTimeout("tcp", c.address, c.timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.br = bufio.NewReader(conn)
+
+	if c.password != "" {
+		_, err = c.roundTrip([]string{"AUTH", c.password})
+		if err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+
+	if c.db != 0 {
+		_, err = c.roundTrip([]string{"SELECT", strconv.Itoa(c.db)})
+		if err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+
+	_, err := c.conn.Write([]byte(b.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+// Error implements the error interface
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *redisClient) readLine() (string, error) {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: invalid reply line")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.br, buf)
+		if err != nil {
+			return nil, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, fmt.Errorf("redis: invalid bulk string")
+		}
+		return string(buf[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+
+		// nil elements are returned as nil and error elements as redisError,
+		// so that the rest of the reply is still read
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = c.readReply()
+			if err != nil {
+				var redisErr redisError
+				if errors.As(err, &redisErr) {
+					items[i] = redisErr
+				} else if !errors.Is(err, errNil) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+}
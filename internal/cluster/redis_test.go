@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exchange is a command expected by fakeRedis and the reply it sends back
+type exchange struct {
+	cmd []string
+	// reply is written in chunks, so that the client has to read it in parts
+	reply []string
+	// hangUp closes the connection after the reply
+	hangUp bool
+	// delay is the time the reply takes to be sent
+	delay time.Duration
+}
+
+// fakeRedis serves the connections of a client over net.Pipe, following a script
+// of exchanges for each connection
+type fakeRedis struct {
+	t       *testing.T
+	scripts [][]exchange
+	dials   int
+}
+
+func (f *fakeRedis) dial() (net.Conn, error) {
+	if f.dials >= len(f.scripts) {
+		return nil, errors.New("connection refused")
+	}
+	script := f.scripts[f.dials]
+	f.dials++
+
+	client, server := net.Pipe()
+	go f.serve(server, script)
+	return client, nil
+}
+
+func (f *fakeRedis) serve(conn net.Conn, script []exchange) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	for _, ex := range script {
+		cmd, err := readCommand(br)
+		if err != nil {
+			f.t.Errorf("reading command: %v", err)
+			return
+		}
+		if !reflect.DeepEqual(cmd, ex.cmd) {
+			f.t.Errorf("command = %q, want %q", cmd, ex.cmd)
+		}
+
+		time.Sleep(ex.delay)
+
+		for _, chunk := range ex.reply {
+			_, err = conn.Write([]byte(chunk))
+			if err != nil {
+				return
+			}
+		}
+
+		if ex.hangUp {
+			return
+		}
+	}
+
+	// wait for the client to close the connection
+	io.Copy(io.Discard, conn) //nolint:errcheck
+}
+
+// readCommand reads a command encoded as an array of bulk strings
+func readCommand(br *bufio.Reader) ([]string, error) {
+	readInt := func(prefix byte) (int, error) {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if line[0] != prefix || !strings.HasSuffix(line, "\r\n") {
+			return 0, errors.New("invalid line " + strconv.Quote(line))
+		}
+		return strconv.Atoi(line[1 : len(line)-2])
+	}
+
+	n, err := readInt('*')
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := make([]string, n)
+	for i := range cmd {
+		l, err := readInt('$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, l+2)
+		_, err = io.ReadFull(br, buf)
+		if err != nil {
+			return nil, err
+		}
+		cmd[i] = string(buf[:l])
+	}
+	return cmd, nil
+}
+
+func TestRedisClientReplies(t *testing.T) {
+	for _, ca := range []struct {
+		name  string
+		reply []string
+		want  interface{}
+		err   error
+	}{
+		{"simple string", []string{"+OK\r\n"}, "OK", nil},
+		{"integer", []string{":42\r\n"}, int64(42), nil},
+		{"bulk string", []string{"$5\r\nhello\r\n"}, "hello", nil},
+		{"empty bulk string", []string{"$0\r\n\r\n"}, "", nil},
+		{"bulk string with line breaks", []string{"$4\r\na\r\nb\r\n"}, "a\r\nb", nil},
+		{"nil bulk string", []string{"$-1\r\n"}, nil, errNil},
+		{"nil array", []string{"*-1\r\n"}, nil, errNil},
+		{"error", []string{"-ERR unknown command\r\n"}, nil, redisError("ERR unknown command")},
+		{
+			"array",
+			[]string{"*4\r\n$1\r\na\r\n$-1\r\n-ERR wrong\r\n:1\r\n"},
+			[]interface{}{"a", nil, redisError("ERR wrong"), int64(1)},
+			nil,
+		},
+		{"partial line", []string{"+O", "K\r", "\n"}, "OK", nil},
+		{"partial bulk string", []string{"$11\r", "\nhello ", "world", "\r\n"}, "hello world", nil},
+		{"partial array", []string{"*2\r\n$1\r\n", "a\r\n:", "7\r\n"}, []interface{}{"a", int64(7)}, nil},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			f := &fakeRedis{t: t, scripts: [][]exchange{{
+				{cmd: []string{"GET", "key"}, reply: ca.reply},
+				{cmd: []string{"PING"}, reply: []string{"+PONG\r\n"}},
+			}}}
+			c := &redisClient{timeout: time.Second, dial: f.dial}
+			defer c.close()
+
+			res, err := c.do("GET", "key")
+			if !reflect.DeepEqual(err, ca.err) {
+				t.Fatalf("err = %v, want %v", err, ca.err)
+			}
+			if !reflect.DeepEqual(res, ca.want) {
+				t.Fatalf("reply = %#v, want %#v", res, ca.want)
+			}
+
+			// the connection is still usable
+			res, err = c.do("PING")
+			if err != nil || res != "PONG" {
+				t.Fatalf("PING = %v, %v", res, err)
+			}
+			if f.dials != 1 {
+				t.Fatalf("dialed %d times, want 1", f.dials)
+			}
+		})
+	}
+}
+
+func TestRedisClientReconnect(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		ex   exchange
+	}{
+		{"connection closed", exchange{hangUp: true}},
+		{"connection closed during reply", exchange{reply: []string{"$5\r\nhel"}, hangUp: true}},
+		{"timeout", exchange{reply: []string{"$5\r\nhel"}}},
+		{"invalid reply type", exchange{reply: []string{"?\r\n"}}},
+		{"invalid integer", exchange{reply: []string{":abc\r\n"}}},
+		{"missing carriage return", exchange{reply: []string{"+OK\n"}}},
+		{"invalid bulk string", exchange{reply: []string{"$2\r\nabcd\r\n"}}},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			ca.ex.cmd = []string{"GET", "key"}
+			f := &fakeRedis{t: t, scripts: [][]exchange{
+				{ca.ex},
+				{{cmd: []string{"GET", "key"}, reply: []string{"$3\r\nabc\r\n"}}},
+			}}
+			c := &redisClient{timeout: 200 * time.Millisecond, dial: f.dial}
+			defer c.close()
+
+			_, err := c.do("GET", "key")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			var redisErr redisError
+			if errors.As(err, &redisErr) || errors.Is(err, errNil) {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			// the broken connection is replaced by a new one
+			res, err := c.do("GET", "key")
+			if err != nil || res != "abc" {
+				t.Fatalf("GET = %v, %v", res, err)
+			}
+			if f.dials != 2 {
+				t.Fatalf("dialed %d times, want 2", f.dials)
+			}
+		})
+	}
+}
+
+func TestRedisClientConnect(t *testing.T) {
+	f := &fakeRedis{t: t, scripts: [][]exchange{
+		{
+			{cmd: []string{"AUTH", "secret"}, reply: []string{"-WRONGPASS invalid password\r\n"}},
+		},
+		{
+			{cmd: []string{"AUTH", "secret"}, reply: []string{"+OK\r\n"}},
+			{cmd: []string{"SELECT", "2"}, reply: []string{"+OK\r\n"}},
+			{cmd: []string{"PING"}, reply: []string{"+PONG\r\n"}},
+		},
+	}}
+	c := &redisClient{password: "secret", db: 2, timeout: time.Second, dial: f.dial}
+	defer c.close()
+
+	_, err := c.do("PING")
+	if !reflect.DeepEqual(err, redisError("WRONGPASS invalid password")) {
+		t.Fatalf("err = %v", err)
+	}
+
+	res, err := c.do("PING")
+	if err != nil || res != "PONG" {
+		t.Fatalf("PING = %v, %v", res, err)
+	}
+}
@@ -0,0 +1,242 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"matek-video-streamer/internal/config"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ownerCacheTTL is the time after which the cached owner of a path is looked up again
+	ownerCacheTTL = 2 * time.Second
+	// ownerLookupTimeout is the time a request waits for the owner of a path that isn't cached yet
+	ownerLookupTimeout = 250 * time.Millisecond
+	// ownerCacheExpiry is the time after which paths that nobody asks for are dropped from the cache
+	ownerCacheExpiry = time.Minute
+)
+
+// ownerEntry is the cached owner of a path
+type ownerEntry struct {
+	owner string
+	// err is the error of the last lookup, while the owner has never been found
+	err error
+	// updated is the time of the last lookup, zero until the first one completes
+	updated    time.Time
+	used       time.Time
+	refreshing bool
+	// ready is closed when the first lookup completes
+	ready chan struct{}
+}
+
+// Registry stores in Redis which instance serves each path, so that a fleet of
+// streamers behind a load balancer can send clients to the instance that owns a stream.
+// Entries expire after a TTL and are refreshed while the instance is alive.
+type Registry struct {
+	conf   config.ClusterConfig
+	client *redisClient
+
+	mutex     sync.Mutex
+	paths     map[string]struct{}
+	owners    map[string]*ownerEntry
+	lookups   sync.WaitGroup
+	ctx       context.Context
+	ctxCancel func()
+	done      chan struct{}
+}
+
+func NewRegistry(conf config.ClusterConfig) *Registry {
+	return &Registry{
+		conf: conf,
+		client: &redisClient{
+			address:  conf.RedisAddress,
+			password: conf.RedisPassword,
+			db:       conf.RedisDB,
+			timeout:  5 * time.Second,
+		},
+		paths:  make(map[string]struct{}),
+		owners: make(map[string]*ownerEntry),
+	}
+}
+
+func (r *Registry) Initialize() error {
+	_, err := r.client.do("PING")
+	if err != nil {
+		return err
+	}
+
+	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
+	r.done = make(chan struct{})
+
+	go r.run()
+
+	return nil
+}
+
+// Close removes the paths owned by this instance from the registry
+func (r *Registry) Close() {
+	r.ctxCancel()
+	<-r.done
+	r.lookups.Wait()
+
+	r.mutex.Lock()
+	paths := r.paths
+	r.paths = make(map[string]struct{})
+	r.mutex.Unlock()
+
+	for path := range paths {
+		r.remove(path)
+	}
+
+	r.client.close()
+}
+
+// Address returns the address of this instance, as advertised to the other instances
+func (r *Registry) Address() string {
+	return r.conf.PublicAddress
+}
+
+// Register announces that this instance serves the given path
+func (r *Registry) Register(path string) {
+	r.mutex.Lock()
+	r.paths[path] = struct{}{}
+	r.mutex.Unlock()
+
+	err := r.set(path)
+	if err != nil {
+		log.Printf("failed to register path /%s: %v", path, err)
+	}
+}
+
+// Unregister announces that this instance does not serve the given path anymore
+func (r *Registry) Unregister(path string) {
+	r.mutex.Lock()
+	delete(r.paths, path)
+	r.mutex.Unlock()
+
+	r.remove(path)
+}
+
+// Owner returns the address of the instance that serves the given path,
+// or an empty string if no instance serves it. Owners are cached and looked up
+// again in the background, so that a slow registry doesn't hold up requests.
+func (r *Registry) Owner(path string) (string, error) {
+	r.mutex.Lock()
+	e, ok := r.owners[path]
+	if !ok {
+		e = &ownerEntry{ready: make(chan struct{})}
+		r.owners[path] = e
+	}
+	e.used = time.Now()
+	if !e.refreshing && time.Since(e.updated) >= ownerCacheTTL && r.ctx.Err() == nil {
+		e.refreshing = true
+		r.lookups.Add(1)
+		go r.lookup(path, e)
+	}
+	r.mutex.Unlock()
+
+	select {
+	case <-e.ready:
+	case <-time.After(ownerLookupTimeout):
+		return "", fmt.Errorf("timed out looking up the owner of path /%s", path)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return e.owner, e.err
+}
+
+// lookup reads the owner of a path from Redis into the cache
+func (r *Registry) lookup(path string, e *ownerEntry) {
+	defer r.lookups.Done()
+
+	var owner string
+	res, err := r.client.do("GET", r.key(path))
+	if err == nil {
+		owner, _ = res.(string)
+	} else if errors.Is(err, errNil) {
+		err = nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	first := e.updated.IsZero()
+
+	// keep the last known owner while Redis can't be reached
+	if err == nil {
+		e.owner = owner
+		e.err = nil
+	} else if first || e.err != nil {
+		e.err = err
+	}
+
+	e.updated = time.Now()
+	e.refreshing = false
+
+	if first {
+		close(e.ready)
+	}
+}
+
+func (r *Registry) key(path string) string {
+	return r.conf.KeyPrefix + ":paths:" + path
+}
+
+func (r *Registry) set(path string) error {
+	ttl := time.Duration(r.conf.TTL).Milliseconds()
+	_, err := r.client.do("SET", r.key(path), r.conf.PublicAddress, "PX", strconv.FormatInt(ttl, 10))
+	return err
+}
+
+// removeScript deletes a key only if it still holds the given value, so that
+// entries that another instance took over in the meantime are kept
+const removeScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+func (r *Registry) remove(path string) {
+	_, err := r.client.do("EVAL", removeScript, "1", r.key(path), r.conf.PublicAddress)
+	if err != nil {
+		log.Printf("failed to unregister path /%s: %v", path, err)
+	}
+}
+
+// run refreshes the entries of this instance before they expire
+// and drops the cached owners of paths that nobody asks for
+func (r *Registry) run() {
+	defer close(r.done)
+
+	t := time.NewTicker(time.Duration(r.conf.TTL) / 3)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			r.mutex.Lock()
+			paths := make([]string, 0, len(r.paths))
+			for path := range r.paths {
+				paths = append(paths, path)
+			}
+			for path, e := range r.owners {
+				if !e.refreshing && time.Since(e.used) >= ownerCacheExpiry {
+					delete(r.owners, path)
+				}
+			}
+			r.mutex.Unlock()
+
+			for _, path := range paths {
+				err := r.set(path)
+				if err != nil {
+					log.Printf("failed to refresh path /%s: %v", path, err)
+				}
+			}
+
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
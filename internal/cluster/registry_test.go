@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"matek-video-streamer/internal/config"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(f *fakeRedis) *Registry {
+	r := NewRegistry(config.ClusterConfig{
+		KeyPrefix:     "vs",
+		PublicAddress: "10.0.0.1:8554",
+		TTL:           config.Duration(15 * time.Second),
+	})
+	r.client.dial = f.dial
+	r.client.timeout = time.Second
+	return r
+}
+
+func TestRegistryUnregister(t *testing.T) {
+	// the entry is deleted only if this instance still owns it, in a single command
+	f := &fakeRedis{t: t, scripts: [][]exchange{{
+		{cmd: []string{"EVAL", removeScript, "1", "vs:paths:cam", "10.0.0.1:8554"}, reply: []string{":0\r\n"}},
+	}}}
+	r := newTestRegistry(f)
+	defer r.client.close()
+
+	r.Unregister("cam")
+}
+
+func TestRegistryOwner(t *testing.T) {
+	f := &fakeRedis{t: t, scripts: [][]exchange{{
+		{cmd: []string{"PING"}, reply: []string{"+PONG\r\n"}},
+		{cmd: []string{"GET", "vs:paths:cam"}, reply: []string{"$13\r\n10.0.0.2:8554\r\n"}},
+		{cmd: []string{"GET", "vs:paths:other"}, reply: []string{"$-1\r\n"}},
+	}}}
+	r := newTestRegistry(f)
+	err := r.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	owner, err := r.Owner("cam")
+	if err != nil || owner != "10.0.0.2:8554" {
+		t.Fatalf("Owner = %q, %v", owner, err)
+	}
+
+	owner, err = r.Owner("other")
+	if err != nil || owner != "" {
+		t.Fatalf("Owner = %q, %v", owner, err)
+	}
+
+	// the owner is cached, Redis is not asked again
+	owner, err = r.Owner("cam")
+	if err != nil || owner != "10.0.0.2:8554" {
+		t.Fatalf("Owner = %q, %v", owner, err)
+	}
+	r.mutex.Lock()
+	refreshing := r.owners["cam"].refreshing
+	r.mutex.Unlock()
+	if refreshing {
+		t.Fatal("the cached owner is looked up again")
+	}
+}
+
+func TestRegistryOwnerSlow(t *testing.T) {
+	f := &fakeRedis{t: t, scripts: [][]exchange{{
+		{cmd: []string{"PING"}, reply: []string{"+PONG\r\n"}},
+		{cmd: []string{"GET", "vs:paths:cam"}, reply: []string{"$13\r\n10.0.0.2:8554\r\n"}, delay: 2 * ownerLookupTimeout},
+	}}}
+	r := newTestRegistry(f)
+	err := r.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// requests don't wait for a slow registry
+	start := time.Now()
+	_, err = r.Owner("cam")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if d := time.Since(start); d > 2*ownerLookupTimeout {
+		t.Fatalf("Owner took %v", d)
+	}
+
+	// the lookup started by the first request completes in the background
+	time.Sleep(2 * ownerLookupTimeout)
+	owner, err := r.Owner("cam")
+	if err != nil || owner != "10.0.0.2:8554" {
+		t.Fatalf("Owner = %q, %v", owner, err)
+	}
+}
@@ -0,0 +1,364 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"matek-video-streamer/internal/utils"
+)
+
+// Config holds the streamer settings that can be loaded from a JSON file.
+// Command line flags take precedence over values read from the file.
+type Config struct {
+	// Input is the named pipe or file the video is read from
+	Input string `json:"input"`
+	// Path is the RTSP path the stream is served on
+	Path string `json:"path"`
+	// Substream holds the settings of the low resolution copy of the stream
+	Substream SubstreamConfig `json:"substream"`
+	// Encoder holds the settings used when converting files to MPEG-TS
+	Encoder utils.EncoderParams `json:"encoder"`
+	// RTSP holds the settings used when the input is a RTSP camera
+	RTSP RTSPSourceConfig `json:"rtsp"`
+	// Backchannel holds the settings of the ONVIF audio back channel
+	Backchannel BackchannelConfig `json:"backchannel"`
+	// Cluster holds the settings of the registry shared with other instances
+	Cluster ClusterConfig `json:"cluster"`
+	// APIAddress is the address of the HTTP API. When empty, the API is disabled.
+	APIAddress string `json:"api_address"`
+	// Readers holds the settings used to detect readers that went away and to stop readers on shutdown
+	Readers ReadersConfig `json:"readers"`
+	// PathDefaults holds the policies that apply to every path
+	PathDefaults PathConfig `json:"path_defaults"`
+	// Paths holds per-path overrides of PathDefaults, by path without leading and trailing slashes.
+	// Fields missing from an override keep the value of PathDefaults, or for the substream,
+	// the value of its parent path.
+	Paths map[string]json.RawMessage `json:"paths"`
+	// Sources holds the settings of sources registered by programs embedding the streamer, by source name
+	Sources map[string]json.RawMessage `json:"sources"`
+}
+
+// ReadersConfig holds the settings of reader sessions
+type ReadersConfig struct {
+	// KeepaliveTimeout is the time after which UDP readers that stopped sending keepalives
+	// are closed. It is advertised to readers in the Session header of responses.
+	// TCP readers are alive as long as their connection is.
+	KeepaliveTimeout Duration `json:"keepalive_timeout"`
+	// RTCPKeepalive counts RTCP packets, such as receiver reports, as keepalives.
+	// When false, readers must send RTSP requests (OPTIONS or GET_PARAMETER) to stay alive.
+	RTCPKeepalive bool `json:"rtcp_keepalive"`
+	// ByeOnShutdown sends a RTCP BYE to readers when the server stops,
+	// so that they can tell a clean stop from a crash
+	ByeOnShutdown bool `json:"bye_on_shutdown"`
+}
+
+// PathConfig holds the policies of a path
+type PathConfig struct {
+	// ReadUser and ReadPass are the credentials readers must provide.
+	// When ReadUser is empty, anyone can read the path.
+	ReadUser string `json:"read_user"`
+	ReadPass string `json:"read_pass"`
+	// Multicast allows readers to use the UDP multicast transport
+	Multicast bool `json:"multicast"`
+	// GOPCache sends the current group of pictures to new readers, so that they
+	// can start decoding immediately instead of waiting for the next IDR
+	GOPCache bool `json:"gop_cache"`
+	// LatencyProfile is either "normal" or "low". With "low", readers always
+	// join at the live edge, the GOP cache is not used and slices received from
+	// RTSP cameras are forwarded as soon as they arrive. The encoder feeding
+	// the input is out of reach of the streamer, so its latency is unaffected.
+	LatencyProfile string `json:"latency_profile"`
+	// Record saves the stream into MPEG-TS segments in RecordDir
+	Record    bool   `json:"record"`
+	RecordDir string `json:"record_dir"`
+	// RecordSegmentDuration is the duration of each recorded segment
+	RecordSegmentDuration Duration `json:"record_segment_duration"`
+}
+
+// UseGOPCache returns whether new readers are sent the current group of pictures
+func (conf PathConfig) UseGOPCache() bool {
+	return conf.GOPCache && conf.LatencyProfile != "low"
+}
+
+// ForwardSlices returns whether slices are sent as soon as they are received,
+// instead of waiting for complete access units
+func (conf PathConfig) ForwardSlices() bool {
+	return conf.LatencyProfile == "low"
+}
+
+// Validate checks the policies for invalid values
+func (conf PathConfig) Validate() error {
+	if conf.ReadUser == "" && conf.ReadPass != "" {
+		return fmt.Errorf("read_pass is set without read_user")
+	}
+
+	switch conf.LatencyProfile {
+	case "normal", "low":
+	default:
+		return fmt.Errorf("invalid latency profile: %s", conf.LatencyProfile)
+	}
+
+	if conf.Record {
+		if conf.RecordDir == "" {
+			return fmt.Errorf("record_dir cannot be empty")
+		}
+		if conf.RecordSegmentDuration < Duration(time.Second) {
+			return fmt.Errorf("record_segment_duration must be at least one second")
+		}
+	}
+
+	return nil
+}
+
+// RTSPSourceConfig holds the settings used to pull a stream from a RTSP camera
+type RTSPSourceConfig struct {
+	// Username and Password are sent with basic or digest authentication,
+	// depending on what the camera asks for
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Transport is one of "auto", "udp" or "tcp". With "auto", UDP is tried
+	// first and the client switches to TCP when no packets arrive within UDPTimeout.
+	Transport string `json:"transport"`
+	// UDPTimeout is the time to wait for the first UDP packet before switching to TCP
+	UDPTimeout Duration `json:"udp_timeout"`
+	// ReconnectDelay is the delay before the first reconnection attempt.
+	// It doubles after every failed attempt, up to ReconnectMaxDelay.
+	ReconnectDelay    Duration `json:"reconnect_delay"`
+	ReconnectMaxDelay Duration `json:"reconnect_max_delay"`
+}
+
+// SubstreamConfig holds the settings of the substream, a downscaled copy of the
+// stream served on "<path>_sub", as NVRs expect for grid views
+type SubstreamConfig struct {
+	Enable     bool   `json:"enable"`
+	Resolution string `json:"resolution"`
+	FPS        int    `json:"fps"`
+	Bitrate    string `json:"bitrate"`
+}
+
+// EncoderParams returns the encoder settings of the substream, with a GOP of one second
+func (conf SubstreamConfig) EncoderParams() utils.EncoderParams {
+	return utils.EncoderParams{
+		Keyint:     conf.FPS,
+		Bitrate:    conf.Bitrate,
+		Preset:     "ultrafast",
+		Resolution: conf.Resolution,
+	}
+}
+
+// SubstreamPath returns the path the substream of a stream is served on
+func SubstreamPath(path string) string {
+	return path + "_sub"
+}
+
+// BackchannelConfig holds the settings of the ONVIF audio back channel, which allows
+// readers to send G711 mu-law audio to a speaker attached to the device
+type BackchannelConfig struct {
+	Enable bool `json:"enable"`
+	// Sink is a file or named pipe path, or a command prefixed with "exec:"
+	// that reads raw audio from its standard input
+	Sink string `json:"sink"`
+}
+
+// ClusterConfig holds the settings of the Redis registry that maps each path
+// to the instance serving it, so that clients can be redirected to the right instance
+type ClusterConfig struct {
+	Enable        bool   `json:"enable"`
+	RedisAddress  string `json:"redis_address"`
+	RedisPassword string `json:"redis_password"`
+	RedisDB       int    `json:"redis_db"`
+	// KeyPrefix is prepended to all the keys written to Redis
+	KeyPrefix string `json:"key_prefix"`
+	// PublicAddress is the host:port clients use to reach this instance
+	PublicAddress string `json:"public_address"`
+	// TTL is the lifetime of the entries of this instance, which are refreshed
+	// periodically and expire when the instance dies
+	TTL Duration `json:"ttl"`
+}
+
+// Duration is a time.Duration that is written as a string (e.g. "5s") in the configuration file
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("invalid duration: %s", string(b))
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Default returns the configuration used when no file is provided
+func Default() *Config {
+	return &Config{
+		Input:   "/tmp/camera_stream",
+		Encoder: utils.DefaultEncoderParams(),
+		Substream: SubstreamConfig{
+			Resolution: "640x360",
+			FPS:        10,
+			Bitrate:    "500k",
+		},
+		RTSP: RTSPSourceConfig{
+			Transport:         "auto",
+			UDPTimeout:        Duration(3 * time.Second),
+			ReconnectDelay:    Duration(1 * time.Second),
+			ReconnectMaxDelay: Duration(30 * time.Second),
+		},
+		Backchannel: BackchannelConfig{
+			Sink: "exec:aplay -q -t raw -f MU_LAW -r 8000 -c 1",
+		},
+		Cluster: ClusterConfig{
+			RedisAddress: "127.0.0.1:6379",
+			KeyPrefix:    "video-streamer",
+			TTL:          Duration(15 * time.Second),
+		},
+		Readers: ReadersConfig{
+			KeepaliveTimeout: Duration(60 * time.Second),
+			RTCPKeepalive:    true,
+			ByeOnShutdown:    true,
+		},
+		PathDefaults: PathConfig{
+			Multicast:             true,
+			LatencyProfile:        "normal",
+			RecordDir:             "recordings",
+			RecordSegmentDuration: Duration(10 * time.Minute),
+		},
+	}
+}
+
+// PathConf returns the policies of a path: the defaults with the overrides of the path applied on top.
+// The substream inherits the policies of its parent path instead of the defaults.
+func (conf *Config) PathConf(path string) PathConfig {
+	// overrides are checked by Validate
+	pathConf, _ := conf.resolvePath(path)
+	return pathConf
+}
+
+func (conf *Config) resolvePath(path string) (PathConfig, error) {
+	pathConf := conf.PathDefaults
+
+	if path == SubstreamPath(conf.Path) {
+		var err error
+		pathConf, err = conf.resolvePath(conf.Path)
+		if err != nil {
+			return PathConfig{}, err
+		}
+	}
+
+	if raw, ok := conf.Paths[path]; ok {
+		err := json.Unmarshal(raw, &pathConf)
+		if err != nil {
+			return PathConfig{}, err
+		}
+	}
+
+	return pathConf, nil
+}
+
+// Load reads a configuration file. Fields missing from the file keep their default value.
+func Load(path string) (*Config, error) {
+	conf := Default()
+
+	if path == "" {
+		return conf, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+
+	err = json.Unmarshal(data, conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+
+	return conf, nil
+}
+
+// Decode unmarshals the configuration into v, which can be a Config or the settings of a source
+func (conf *Config) Decode(v any) error {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Validate checks the configuration for invalid values
+func (conf *Config) Validate() error {
+	switch conf.RTSP.Transport {
+	case "auto", "udp", "tcp":
+	default:
+		return fmt.Errorf("invalid RTSP transport: %s", conf.RTSP.Transport)
+	}
+
+	if conf.RTSP.ReconnectDelay <= 0 || conf.RTSP.ReconnectMaxDelay < conf.RTSP.ReconnectDelay {
+		return fmt.Errorf("invalid RTSP reconnect delays")
+	}
+
+	if conf.Substream.Enable {
+		err := conf.Substream.EncoderParams().Validate()
+		if err != nil {
+			return fmt.Errorf("invalid substream: %v", err)
+		}
+	}
+
+	if conf.Backchannel.Enable && conf.Backchannel.Sink == "" {
+		return fmt.Errorf("back channel sink cannot be empty")
+	}
+
+	if conf.Cluster.Enable {
+		if conf.Cluster.PublicAddress == "" {
+			return fmt.Errorf("cluster public address cannot be empty")
+		}
+		if conf.Cluster.TTL < Duration(time.Second) {
+			return fmt.Errorf("cluster TTL must be at least one second")
+		}
+	}
+
+	// gortsplib closes UDP sessions that don't send requests nor RTCP packets for 60 seconds
+	if conf.Readers.KeepaliveTimeout < Duration(time.Second) || conf.Readers.KeepaliveTimeout > Duration(60*time.Second) {
+		return fmt.Errorf("readers keepalive timeout must be between 1s and 60s")
+	}
+
+	err := conf.PathDefaults.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid path defaults: %v", err)
+	}
+
+	paths := []string{conf.Path, SubstreamPath(conf.Path)}
+	for path := range conf.Paths {
+		paths = append(paths, path)
+	}
+
+	for _, path := range paths {
+		var pathConf PathConfig
+		pathConf, err = conf.resolvePath(path)
+		if err != nil {
+			return fmt.Errorf("invalid config of path /%s: %v", path, err)
+		}
+
+		err = pathConf.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid config of path /%s: %v", path, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/pion/rtp"
+)
+
+// backchannelWriteTimeout is the time after which audio is dropped when the sink doesn't accept it
+const backchannelWriteTimeout = 100 * time.Millisecond
+
+// Backchannel receives audio sent by readers through the ONVIF audio back channel
+// and forwards it to a sink, which is usually a speaker attached to the device.
+// Audio is G711 mu-law at 8kHz mono, and is written to the sink without any header.
+// Only one reader at a time can talk. The others are ignored until it leaves,
+// then the reader that started playing first takes over.
+type Backchannel struct {
+	// a file or named pipe path, or a command prefixed with "exec:" that reads audio from stdin
+	Sink string
+
+	media *description.Media
+	mutex sync.Mutex
+	// sessions that set up the back channel, in the order they started playing
+	sessions []*gortsplib.ServerSession
+	owner    *gortsplib.ServerSession
+	w        *os.File
+	cmd      *exec.Cmd
+}
+
+// Media returns the sendonly audio media that must be added to the stream description
+func (b *Backchannel) Media() *description.Media {
+	if b.media == nil {
+		b.media = &description.Media{
+			Type:          description.MediaTypeAudio,
+			IsBackChannel: true,
+			Formats: []format.Format{&format.G711{
+				PayloadTyp:   0,
+				MULaw:        true,
+				SampleRate:   8000,
+				ChannelCount: 1,
+			}},
+		}
+	}
+	return b.media
+}
+
+// attach routes audio of the session to the sink, once no other session is talking
+func (b *Backchannel) attach(ss *gortsplib.ServerSession) {
+	var medi *description.Media
+	for _, m := range ss.SetuppedMedias() {
+		if m.IsBackChannel {
+			medi = m
+			break
+		}
+	}
+	if medi == nil {
+		return
+	}
+
+	// audio of sessions that are not the owner is dropped by write
+	ss.OnPacketRTP(medi, medi.Formats[0], func(pkt *rtp.Packet) {
+		b.write(ss, pkt.Payload)
+	})
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.sessions = append(b.sessions, ss)
+
+	if b.owner != nil {
+		log.Printf("back channel is already in use, the new reader will talk when it is released")
+		return
+	}
+	b.handOver()
+}
+
+// detach stops routing audio of the session to the sink, and hands the sink to the next session
+func (b *Backchannel) detach(ss *gortsplib.ServerSession) {
+	b.mutex.Lock()
+
+	b.sessions = slices.DeleteFunc(b.sessions, func(s *gortsplib.ServerSession) bool {
+		return s == ss
+	})
+
+	if b.owner != ss {
+		b.mutex.Unlock()
+		return
+	}
+
+	cmd := b.release()
+	b.mutex.Unlock()
+
+	log.Printf("back channel closed")
+
+	// the next sink command starts once the previous one has exited, since both may use the same device
+	b.wait(cmd)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.owner == nil {
+		b.handOver()
+	}
+}
+
+func (b *Backchannel) write(ss *gortsplib.ServerSession, payload []byte) {
+	b.mutex.Lock()
+
+	if b.owner != ss {
+		b.mutex.Unlock()
+		return
+	}
+
+	b.w.SetWriteDeadline(time.Now().Add(backchannelWriteTimeout))
+	_, err := b.w.Write(payload)
+	// a sink that can't keep up loses audio, but the reader can keep talking
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.EAGAIN) {
+		b.mutex.Unlock()
+		return
+	}
+
+	log.Printf("failed to write to back channel sink: %v", err)
+
+	// the sink is opened again when another reader starts playing or leaves,
+	// instead of failing again on every packet
+	cmd := b.release()
+	b.mutex.Unlock()
+
+	b.wait(cmd)
+}
+
+// handOver opens the sink for the first waiting session. It must be called with the mutex held.
+func (b *Backchannel) handOver() {
+	if len(b.sessions) == 0 {
+		return
+	}
+
+	err := b.open()
+	if err != nil {
+		log.Printf("failed to open back channel sink: %v", err)
+		return
+	}
+	b.owner = b.sessions[0]
+
+	log.Printf("back channel opened")
+}
+
+func (b *Backchannel) open() error {
+	if cmdline, ok := strings.CutPrefix(b.Sink, "exec:"); ok {
+		args := strings.Fields(cmdline)
+		if len(args) == 0 {
+			return fmt.Errorf("empty sink command")
+		}
+
+		// unlike the pipe of cmd.StdinPipe, os.Pipe supports write deadlines
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = r
+
+		err = cmd.Start()
+		r.Close()
+		if err != nil {
+			w.Close()
+			return err
+		}
+
+		b.cmd = cmd
+		b.w = w
+		return nil
+	}
+
+	// a named pipe without a reader is reported as an error instead of blocking
+	f, err := os.OpenFile(b.Sink, os.O_WRONLY|os.O_CREATE|os.O_APPEND|syscall.O_NONBLOCK, 0o644)
+	if err != nil {
+		return err
+	}
+
+	b.w = f
+	return nil
+}
+
+// release closes the sink. It must be called with the mutex held, and the returned
+// command, if any, must be waited for with the mutex released.
+func (b *Backchannel) release() *exec.Cmd {
+	b.w.Close()
+	cmd := b.cmd
+	b.cmd = nil
+	b.w = nil
+	b.owner = nil
+	return cmd
+}
+
+// wait waits for the sink command to exit, which can take a while for encoders flushing their output
+func (b *Backchannel) wait(cmd *exec.Cmd) {
+	if cmd != nil {
+		cmd.Wait()
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"log"
+	"sync"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/headers"
+	"github.com/pion/rtp"
+)
+
+const (
+	// WriteQueueSize is the size of the write queue of sessions, which must be set on the server.
+	// It must be a power of two, and leave room for live packets after a replay of the GOP cache.
+	WriteQueueSize = 8192
+
+	// gopCacheMaxPackets limits the memory used by the cache when random access points are rare.
+	// A replay is queued before the writer of the session starts, so it always fits in the queue.
+	gopCacheMaxPackets = WriteQueueSize / 2
+)
+
+// GOPCache keeps the RTP packets written since the last random access point, so that
+// new readers can start decoding immediately instead of waiting for the next one.
+// Readers served from the cache start slightly behind live.
+type GOPCache struct {
+	mutex    sync.Mutex
+	packets  []*rtp.Packet
+	overflow bool
+}
+
+// Lock prevents packets from being written to the cache and to the stream
+func (c *GOPCache) Lock() {
+	c.mutex.Lock()
+}
+
+// Unlock allows packets to be written again
+func (c *GOPCache) Unlock() {
+	c.mutex.Unlock()
+}
+
+// Write stores the packets of an access unit. A random access point drops the previous group of pictures.
+// It must be called with the cache locked.
+func (c *GOPCache) Write(packets []*rtp.Packet, randomAccess bool) {
+	if randomAccess {
+		c.packets = c.packets[:0]
+		c.overflow = false
+	} else if c.overflow || len(c.packets) == 0 {
+		return
+	}
+
+	if len(c.packets)+len(packets) > gopCacheMaxPackets {
+		c.packets = c.packets[:0]
+		c.overflow = true
+		return
+	}
+
+	for _, pkt := range packets {
+		c.packets = append(c.packets, pkt.Clone())
+	}
+}
+
+// replay sends the cached packets to a reader and returns the first of them, or nil.
+// It must be called with the cache locked, since the reader was made active, so that the
+// packets written afterwards follow the replayed ones. A group of pictures that doesn't fit
+// in the cache is dropped as a whole, so readers never receive a truncated one.
+func (c *GOPCache) replay(ss *gortsplib.ServerSession, medi *description.Media) *rtp.Packet {
+	for _, pkt := range c.packets {
+		err := ss.WritePacketRTP(medi, pkt)
+		if err != nil {
+			log.Printf("failed to replay GOP cache: %v", err)
+			return nil
+		}
+	}
+
+	if len(c.packets) == 0 {
+		return nil
+	}
+	return c.packets[0]
+}
+
+// gopReplay is a replay of the GOP cache to a reader that is starting to play.
+// gortsplib makes the reader active between OnPlay and the response, so the cache is
+// locked from the one to the other: packets written before are replayed, packets
+// written after are sent live, and none is lost or sent twice.
+type gopReplay struct {
+	cache *GOPCache
+	ss    *gortsplib.ServerSession
+	medi  *description.Media
+}
+
+// startReplay locks the cache of a path until the response to the PLAY request is sent
+func (sh *ServerHandler) startReplay(ctx *gortsplib.ServerHandlerOnPlayCtx, p *Path, medi *description.Media) {
+	p.GOPCache.Lock()
+
+	sh.replaysMutex.Lock()
+	defer sh.replaysMutex.Unlock()
+
+	if sh.replays == nil {
+		sh.replays = make(map[*gortsplib.ServerConn]*gopReplay)
+	}
+	sh.replays[ctx.Conn] = &gopReplay{
+		cache: p.GOPCache,
+		ss:    ctx.Session,
+		medi:  medi,
+	}
+}
+
+// finishReplay replays the cache to the reader that sent the PLAY request, now active,
+// and unlocks the cache. The RTP-Info header of the response is pointed at the first
+// replayed packet, since the reader receives it before the live ones.
+func (sh *ServerHandler) finishReplay(conn *gortsplib.ServerConn, res *base.Response) {
+	sh.replaysMutex.Lock()
+	r, ok := sh.replays[conn]
+	delete(sh.replays, conn)
+	sh.replaysMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	defer r.cache.Unlock()
+
+	if res.StatusCode != base.StatusOK {
+		return
+	}
+
+	first := r.cache.replay(r.ss, r.medi)
+	if first == nil {
+		return
+	}
+
+	var ri headers.RTPInfo
+	err := ri.Unmarshal(res.Header["RTP-Info"])
+	if err != nil {
+		return
+	}
+
+	for i, medi := range r.ss.SetuppedMedias() {
+		if medi == r.medi && i < len(ri) {
+			seqNum := first.SequenceNumber
+			ts := first.Timestamp
+			ri[i].SequenceNumber = &seqNum
+			ri[i].Timestamp = &ts
+		}
+	}
+	res.Header["RTP-Info"] = ri.Marshal()
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/headers"
+)
+
+const (
+	// keepaliveCheckPeriod is the period of the check of reader keepalives
+	keepaliveCheckPeriod = 1 * time.Second
+	// byeFlushDelay leaves time to the BYE packets to leave the write queues before the server stops
+	byeFlushDelay = 200 * time.Millisecond
+)
+
+// Initialize starts closing readers that stop sending keepalives
+func (sh *ServerHandler) Initialize() {
+	sh.ctx, sh.ctxCancel = context.WithCancel(context.Background())
+	sh.done = make(chan struct{})
+
+	go sh.runWatchdog()
+}
+
+// Close stops the watchdog and, if enabled, sends a RTCP BYE to all readers,
+// so that they can tell a clean stop from a crash. It must be called while streams
+// are still open, and can be called more than once.
+func (sh *ServerHandler) Close() {
+	sh.closeOnce.Do(func() {
+		sh.ctxCancel()
+		<-sh.done
+
+		if !sh.Readers.ByeOnShutdown {
+			return
+		}
+
+		sh.sessionsMutex.RLock()
+		for _, s := range sh.sessions {
+			s.goodbye()
+		}
+		sh.sessionsMutex.RUnlock()
+
+		time.Sleep(byeFlushDelay)
+	})
+}
+
+// called when receiving a request. Requests of a reader, usually OPTIONS or GET_PARAMETER, keep its session alive.
+// Sessions are matched by connection, since readers send keepalives on the connection they set up the session with.
+func (sh *ServerHandler) OnRequest(conn *gortsplib.ServerConn, _ *base.Request) {
+	sh.sessionsMutex.RLock()
+	defer sh.sessionsMutex.RUnlock()
+
+	for _, s := range sh.sessions {
+		if s.conn == conn {
+			s.onRequest()
+		}
+	}
+}
+
+// called before sending a response. The session timeout advertised by gortsplib
+// is replaced with the configured one, so that readers send keepalives in time.
+// Pending replays of the GOP cache are also completed here, see OnPlay.
+func (sh *ServerHandler) OnResponse(conn *gortsplib.ServerConn, res *base.Response) {
+	sh.finishReplay(conn, res)
+
+	v, ok := res.Header["Session"]
+	if !ok {
+		return
+	}
+
+	var h headers.Session
+	err := h.Unmarshal(v)
+	if err != nil || h.Timeout == nil {
+		return
+	}
+
+	timeout := uint(time.Duration(sh.Readers.KeepaliveTimeout) / time.Second)
+	h.Timeout = &timeout
+	res.Header["Session"] = h.Marshal()
+}
+
+func (sh *ServerHandler) runWatchdog() {
+	defer close(sh.done)
+
+	t := time.NewTicker(keepaliveCheckPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			var expired []*session
+
+			sh.sessionsMutex.RLock()
+			for _, s := range sh.sessions {
+				if s.expired(now, sh.Readers) {
+					expired = append(expired, s)
+				}
+			}
+			sh.sessionsMutex.RUnlock()
+
+			for _, s := range expired {
+				log.Printf("session %s timed out (%s)", s.id, strings.Trim(s.ss.SetuppedPath(), "/"))
+				s.ss.Close()
+			}
+
+		case <-sh.ctx.Done():
+			return
+		}
+	}
+}
@@ -1,17 +1,128 @@
 package server
 
 import (
+	"context"
 	"log"
+	"matek-video-streamer/internal/cluster"
+	"matek-video-streamer/internal/config"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/bluenviron/gortsplib/v4"
 	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/liberrors"
 )
 
+// Path is a stream served by the server, with the policies that apply to it
+type Path struct {
+	Stream *gortsplib.ServerStream
+	Conf   config.PathConfig
+	// GOPCache holds the current group of pictures of the stream, nil when disabled
+	GOPCache *GOPCache
+}
+
 type ServerHandler struct {
 	Server *gortsplib.Server
-	Stream *gortsplib.ServerStream
-	Mutex  sync.RWMutex
+	// paths served by the server, by path without leading and trailing slashes
+	Paths       map[string]*Path
+	Backchannel *Backchannel
+	// registry shared with other instances, used to redirect clients
+	// asking for paths that are served elsewhere
+	Registry *cluster.Registry
+	// Readers holds the keepalive and shutdown settings of readers
+	Readers config.ReadersConfig
+	Mutex   sync.RWMutex
+
+	sessionsMutex sync.RWMutex
+	sessions      map[*gortsplib.ServerSession]*session
+
+	// replays of the GOP cache waiting for the response to PLAY, by connection
+	replaysMutex sync.Mutex
+	replays      map[*gortsplib.ServerConn]*gopReplay
+
+	ctx       context.Context
+	ctxCancel func()
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// findPath returns the path with the given name, or nil
+func (sh *ServerHandler) findPath(path string) *Path {
+	sh.Mutex.RLock()
+	defer sh.Mutex.RUnlock()
+
+	return sh.Paths[strings.Trim(path, "/")]
+}
+
+// authenticate returns a 401 response if the request doesn't carry the credentials of the path
+func (sh *ServerHandler) authenticate(conn *gortsplib.ServerConn, req *base.Request, p *Path) (*base.Response, error) {
+	if p.Conf.ReadUser == "" || conn.VerifyCredentials(req, p.Conf.ReadUser, p.Conf.ReadPass) {
+		return nil, nil
+	}
+
+	return &base.Response{
+		StatusCode: base.StatusUnauthorized,
+	}, liberrors.ErrServerAuth{}
+}
+
+// findSession returns the details of a session, or nil
+func (sh *ServerHandler) findSession(ss *gortsplib.ServerSession) *session {
+	sh.sessionsMutex.RLock()
+	defer sh.sessionsMutex.RUnlock()
+
+	return sh.sessions[ss]
+}
+
+// Sessions returns the details of all the sessions
+func (sh *ServerHandler) Sessions() []SessionInfo {
+	sh.sessionsMutex.RLock()
+	defer sh.sessionsMutex.RUnlock()
+
+	infos := make([]SessionInfo, 0, len(sh.sessions))
+	for _, s := range sh.sessions {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+// Session returns the details of the session with the given ID
+func (sh *ServerHandler) Session(id string) (SessionInfo, bool) {
+	sh.sessionsMutex.RLock()
+	defer sh.sessionsMutex.RUnlock()
+
+	for _, s := range sh.sessions {
+		if s.id == id {
+			return s.info(), true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+// redirect returns a response that sends the client to the instance serving the path,
+// or a 404 response if no other instance serves it
+func (sh *ServerHandler) redirect(req *base.Request, path string) *base.Response {
+	if sh.Registry != nil {
+		owner, err := sh.Registry.Owner(strings.Trim(path, "/"))
+		if err != nil {
+			log.Printf("failed to query registry: %v", err)
+		} else if owner != "" && owner != sh.Registry.Address() {
+			u := req.URL.CloneWithoutCredentials()
+			u.Host = owner
+			log.Printf("redirecting to %s", u)
+
+			return &base.Response{
+				StatusCode: base.StatusFound,
+				Header: base.Header{
+					"Location": base.HeaderValue{u.String()},
+				},
+			}
+		}
+	}
+
+	return &base.Response{
+		StatusCode: base.StatusNotFound,
+	}
 }
 
 // called when a connection is opened.
@@ -25,47 +136,112 @@ func (sh *ServerHandler) OnConnClose(ctx *gortsplib.ServerHandlerOnConnCloseCtx)
 }
 
 // called when a session is opened.
-func (sh *ServerHandler) OnSessionOpen(_ *gortsplib.ServerHandlerOnSessionOpenCtx) {
-	log.Printf("session opened")
+func (sh *ServerHandler) OnSessionOpen(ctx *gortsplib.ServerHandlerOnSessionOpenCtx) {
+	s := newSession(ctx.Session, ctx.Conn)
+	log.Printf("session %s opened", s.id)
+
+	sh.sessionsMutex.Lock()
+	if sh.sessions == nil {
+		sh.sessions = make(map[*gortsplib.ServerSession]*session)
+	}
+	sh.sessions[ctx.Session] = s
+	sh.sessionsMutex.Unlock()
 }
 
 // called when a session is closed.
-func (sh *ServerHandler) OnSessionClose(_ *gortsplib.ServerHandlerOnSessionCloseCtx) {
-	log.Printf("session closed")
+func (sh *ServerHandler) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
+	sh.sessionsMutex.Lock()
+	s := sh.sessions[ctx.Session]
+	delete(sh.sessions, ctx.Session)
+	sh.sessionsMutex.Unlock()
+
+	if s != nil {
+		s.close()
+		log.Printf("session %s closed", s.id)
+	}
+
+	if sh.Backchannel != nil {
+		sh.Backchannel.detach(ctx.Session)
+	}
 }
 
 // called when receiving a DESCRIBE request.
 func (sh *ServerHandler) OnDescribe(
-	_ *gortsplib.ServerHandlerOnDescribeCtx,
+	ctx *gortsplib.ServerHandlerOnDescribeCtx,
 ) (*base.Response, *gortsplib.ServerStream, error) {
-	log.Printf("DESCRIBE request")
+	log.Printf("DESCRIBE request (%s)", ctx.Path)
 
-	sh.Mutex.RLock()
-	defer sh.Mutex.RUnlock()
+	p := sh.findPath(ctx.Path)
+	if p == nil {
+		return sh.redirect(ctx.Request, ctx.Path), nil, nil
+	}
+
+	if res, err := sh.authenticate(ctx.Conn, ctx.Request, p); res != nil {
+		return res, nil, err
+	}
 
 	return &base.Response{
 		StatusCode: base.StatusOK,
-	}, sh.Stream, nil
+	}, p.Stream, nil
 }
 
 // called when receiving a SETUP request.
 func (sh *ServerHandler) OnSetup(
-	_ *gortsplib.ServerHandlerOnSetupCtx,
+	ctx *gortsplib.ServerHandlerOnSetupCtx,
 ) (*base.Response, *gortsplib.ServerStream, error) {
-	log.Printf("SETUP request")
+	log.Printf("SETUP request (%s)", ctx.Path)
 
-	sh.Mutex.RLock()
-	defer sh.Mutex.RUnlock()
+	// clients may skip DESCRIBE and set up a path they already know
+	p := sh.findPath(ctx.Path)
+	if p == nil {
+		return sh.redirect(ctx.Request, ctx.Path), nil, nil
+	}
+
+	if res, err := sh.authenticate(ctx.Conn, ctx.Request, p); res != nil {
+		return res, nil, err
+	}
+
+	if ctx.Transport == gortsplib.TransportUDPMulticast && !p.Conf.Multicast {
+		return &base.Response{
+			StatusCode: base.StatusUnsupportedTransport,
+		}, nil, nil
+	}
+
+	if s := sh.findSession(ctx.Session); s != nil {
+		s.setUser(ctx.Request)
+	}
 
 	return &base.Response{
 		StatusCode: base.StatusOK,
-	}, sh.Stream, nil
+	}, p.Stream, nil
 }
 
 // called when receiving a PLAY request.
-func (sh *ServerHandler) OnPlay(_ *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+func (sh *ServerHandler) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
 	log.Printf("PLAY request")
 
+	// collect statistics from the receiver reports of the reader
+	if s := sh.findSession(ctx.Session); s != nil {
+		s.setUser(ctx.Request)
+		ctx.Session.OnPacketRTCPAny(s.onPacketRTCP)
+	}
+
+	// route audio sent by the reader to the speaker
+	if sh.Backchannel != nil {
+		sh.Backchannel.attach(ctx.Session)
+	}
+
+	// let the reader start decoding immediately. Multicast readers share
+	// a single flow, so they can't be sent packets of their own.
+	// The replay happens once the reader is active, before the response is sent.
+	if p := sh.findPath(ctx.Path); p != nil && p.GOPCache != nil && ctx.Session.State() != gortsplib.ServerSessionStatePlay {
+		medi := p.Stream.Desc.Medias[0]
+		t := ctx.Session.SetuppedTransport()
+		if t != nil && *t != gortsplib.TransportUDPMulticast && slices.Contains(ctx.Session.SetuppedMedias(), medi) {
+			sh.startReplay(ctx, p, medi)
+		}
+	}
+
 	return &base.Response{
 		StatusCode: base.StatusOK,
 	}, nil
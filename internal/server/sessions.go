@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"matek-video-streamer/internal/config"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+)
+
+const (
+	// ntpEpochOffset is the number of seconds between the NTP and the Unix epochs
+	ntpEpochOffset = 2208988800
+	// bitrateSamplePeriod is the period of the samples of the outgoing bitrate
+	bitrateSamplePeriod = 1 * time.Second
+)
+
+// SessionInfo describes a session, as exposed by the API
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Created    time.Time `json:"created"`
+	State      string    `json:"state"`
+	Path       string    `json:"path"`
+	Transport  string    `json:"transport"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user"`
+	// SSRC of the stream sent to the reader, as reported in its receiver reports
+	SSRC *uint32 `json:"ssrc"`
+	// RTT is the round trip time computed from receiver reports, in milliseconds
+	RTT *float64 `json:"rtt"`
+	// Jitter is the interarrival jitter reported by the reader, in milliseconds
+	Jitter *float64 `json:"jitter"`
+	// PacketsLost is the cumulative number of packets lost reported by the reader
+	PacketsLost *uint32 `json:"packets_lost"`
+	BytesSent   uint64  `json:"bytes_sent"`
+	// Bitrate is the outgoing bitrate over the last second, in bits per second
+	Bitrate float64 `json:"bitrate"`
+}
+
+// session holds the details of a session that gortsplib doesn't keep
+type session struct {
+	id         string
+	created    time.Time
+	ss         *gortsplib.ServerSession
+	conn       *gortsplib.ServerConn
+	remoteAddr string
+
+	mutex       sync.Mutex
+	user        string
+	lastRequest time.Time
+	lastRTCP    time.Time
+	report      *rtcp.ReceptionReport
+	rtt         *time.Duration
+	clockRate   int
+	sampleBytes uint64
+	sampleTime  time.Time
+	bitrate     float64
+
+	ctx       context.Context
+	ctxCancel func()
+	done      chan struct{}
+}
+
+func newSession(ss *gortsplib.ServerSession, conn *gortsplib.ServerConn) *session {
+	now := time.Now()
+	s := &session{
+		id:          uuid.New().String(),
+		created:     now,
+		ss:          ss,
+		conn:        conn,
+		remoteAddr:  conn.NetConn().RemoteAddr().String(),
+		lastRequest: now,
+		sampleTime:  now,
+		done:        make(chan struct{}),
+	}
+	s.ctx, s.ctxCancel = context.WithCancel(context.Background())
+
+	go s.run()
+
+	return s
+}
+
+// close stops sampling the bitrate of the session
+func (s *session) close() {
+	s.ctxCancel()
+	<-s.done
+}
+
+// run samples the outgoing bitrate of the session
+func (s *session) run() {
+	defer close(s.done)
+
+	t := time.NewTicker(bitrateSamplePeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			s.sampleBitrate(now)
+
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// setUser stores the user that authenticated the request, if any
+func (s *session) setUser(req *base.Request) {
+	user := requestUser(req)
+	if user == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	s.user = user
+	s.mutex.Unlock()
+}
+
+// onRequest records that the reader sent a RTSP request, which keeps the session alive
+func (s *session) onRequest() {
+	s.mutex.Lock()
+	s.lastRequest = time.Now()
+	s.mutex.Unlock()
+}
+
+// onPacketRTCP extracts statistics from the receiver reports sent by the reader
+func (s *session) onPacketRTCP(medi *description.Media, pkt rtcp.Packet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastRTCP = time.Now()
+
+	rr, ok := pkt.(*rtcp.ReceiverReport)
+	if !ok || len(rr.Reports) == 0 || medi.Type != description.MediaTypeVideo {
+		return
+	}
+
+	report := rr.Reports[0]
+	s.report = &report
+	s.clockRate = medi.Formats[0].ClockRate()
+
+	// RTT = arrival time - last sender report time - delay since last sender report,
+	// all in the compact NTP format (1/65536 seconds)
+	if report.LastSenderReport != 0 {
+		now := time.Now()
+		ntp := uint64(now.Unix()+ntpEpochOffset)<<32 | uint64(now.Nanosecond())<<32/1e9
+		compact := uint32(ntp >> 16)
+
+		// a late or bogus report would give a negative RTT, which is skipped
+		rtt := int64(compact) - int64(report.LastSenderReport) - int64(report.Delay)
+		if rtt >= 0 {
+			d := time.Duration(rtt) * time.Second / 65536
+			s.rtt = &d
+		}
+	}
+}
+
+// expired checks whether a UDP reader stopped sending keepalives
+func (s *session) expired(now time.Time, conf config.ReadersConfig) bool {
+	if s.ss.State() != gortsplib.ServerSessionStatePlay {
+		return false
+	}
+
+	// TCP readers are alive as long as their connection is
+	t := s.ss.SetuppedTransport()
+	if t == nil || *t == gortsplib.TransportTCP {
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	last := s.lastRequest
+	if conf.RTCPKeepalive && s.lastRTCP.After(last) {
+		last = s.lastRTCP
+	}
+
+	return now.Sub(last) >= time.Duration(conf.KeepaliveTimeout)
+}
+
+// goodbye sends a RTCP BYE to the reader, which tells it that the stream is over
+func (s *session) goodbye() {
+	if s.ss.State() != gortsplib.ServerSessionStatePlay {
+		return
+	}
+
+	stats := s.ss.Stats()
+
+	for _, medi := range s.ss.SetuppedMedias() {
+		if medi.IsBackChannel {
+			continue
+		}
+
+		// readers ignore a BYE that doesn't list the SSRCs they receive the media from
+		bye := &rtcp.Goodbye{Reason: "server shutdown"}
+		for _, fs := range stats.Medias[medi].Formats {
+			bye.Sources = append(bye.Sources, fs.LocalSSRC)
+		}
+		slices.Sort(bye.Sources)
+
+		err := s.ss.WritePacketRTCP(medi, bye)
+		if err != nil {
+			log.Printf("failed to send BYE to session %s: %v", s.id, err)
+		}
+	}
+}
+
+// sampleBitrate computes the outgoing bitrate since the previous sample
+func (s *session) sampleBitrate(now time.Time) {
+	bytesSent := s.ss.Stats().BytesSent
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if elapsed := now.Sub(s.sampleTime); elapsed > 0 {
+		s.bitrate = float64(bytesSent-s.sampleBytes) * 8 / elapsed.Seconds()
+	}
+	s.sampleBytes = bytesSent
+	s.sampleTime = now
+}
+
+func (s *session) info() SessionInfo {
+	info := SessionInfo{
+		ID:         s.id,
+		Created:    s.created,
+		State:      s.ss.State().String(),
+		Path:       strings.Trim(s.ss.SetuppedPath(), "/"),
+		RemoteAddr: s.remoteAddr,
+		BytesSent:  s.ss.Stats().BytesSent,
+	}
+
+	if t := s.ss.SetuppedTransport(); t != nil {
+		info.Transport = t.String()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	info.User = s.user
+
+	if s.report != nil {
+		ssrc := s.report.SSRC
+		info.SSRC = &ssrc
+		lost := s.report.TotalLost
+		info.PacketsLost = &lost
+		jitter := float64(s.report.Jitter) * 1000 / float64(s.clockRate)
+		info.Jitter = &jitter
+	}
+
+	if s.rtt != nil {
+		rtt := float64(*s.rtt) / float64(time.Millisecond)
+		info.RTT = &rtt
+	}
+
+	info.Bitrate = s.bitrate
+
+	return info
+}
+
+// requestUser returns the user name sent in the Authorization header of a request
+func requestUser(req *base.Request) string {
+	v, ok := req.Header["Authorization"]
+	if !ok || len(v) != 1 {
+		return ""
+	}
+
+	if encoded, ok := strings.CutPrefix(v[0], "Basic "); ok {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return ""
+		}
+		user, _, _ := strings.Cut(string(decoded), ":")
+		return user
+	}
+
+	if params, ok := strings.CutPrefix(v[0], "Digest "); ok {
+		for _, param := range strings.Split(params, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && key == "username" {
+				return strings.Trim(value, `"`)
+			}
+		}
+	}
+
+	return ""
+}
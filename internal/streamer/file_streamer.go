@@ -1,20 +1,64 @@
 package streamer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"matek-video-streamer/internal/utils"
+	"matek-video-streamer/pkg/source"
 	"os"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/bluenviron/gortsplib/v4"
 	"github.com/bluenviron/gortsplib/v4/pkg/format"
 	"github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts"
 	"github.com/pion/rtp"
 )
 
+// mpegtsPacketSize is the size of MPEG-TS packets, which start with a sync byte
+const mpegtsPacketSize = 188
+
+const (
+	// reopenDelay is the delay before trying again to open an input that can't be opened
+	reopenDelay = 100 * time.Millisecond
+	// reopenMaxDelay is the maximum delay between attempts to open the input
+	reopenMaxDelay = 5 * time.Second
+	// pipeCheckPeriod is the period of the check for a replaced pipe while waiting for a writer
+	pipeCheckPeriod = 500 * time.Millisecond
+)
+
+func init() {
+	source.Register(&source.Source{
+		Name: "mpegts",
+		Matchers: []source.Matcher{
+			source.MatchNamedPipe(),
+			source.MatchExtension(".ts", ".m2ts", ".mts"),
+			source.MatchContent(isMPEGTS),
+		},
+		Probe: func(_ context.Context, address string, _ source.Settings) (*source.Parameters, error) {
+			params, err := utils.ExtractH264ParametersFromPipe(address, 10*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			return &source.Parameters{SPS: params.SPS, PPS: params.PPS}, nil
+		},
+		New: func(address string, out *source.Output, _ source.Settings) (source.Streamer, error) {
+			return New(out, address), nil
+		},
+	})
+}
+
+// isMPEGTS checks whether data starts with MPEG-TS packets
+func isMPEGTS(header []byte) bool {
+	if len(header) < mpegtsPacketSize*2 {
+		return false
+	}
+	return header[0] == 0x47 && header[mpegtsPacketSize] == 0x47
+}
+
 func findTrack(r *mpegts.Reader) (*mpegts.Track, error) {
 	for _, track := range r.Tracks() {
 		if _, ok := track.Codec.(*mpegts.CodecH264); ok {
@@ -24,24 +68,27 @@ func findTrack(r *mpegts.Reader) (*mpegts.Track, error) {
 	return nil, fmt.Errorf("H264 track not found")
 }
 
-func New(
-	stream *gortsplib.ServerStream,
-	pipeName string,
-) *fileStreamer {
+func New(out *source.Output, pipeName string) *fileStreamer {
 	if pipeName == "" {
 		log.Fatalf("pipeName cannot be empty")
 		return nil
 	}
 	return &fileStreamer{
-		stream:   stream,
+		out:      out,
 		pipeName: pipeName,
 	}
 }
 
 type fileStreamer struct {
-	stream   *gortsplib.ServerStream
+	out      *source.Output
 	pipeName string
-	f        *os.File
+
+	ctx       context.Context
+	ctxCancel func()
+	done      chan struct{}
+	// mutex protects f, which is replaced when the input is reopened
+	mutex sync.Mutex
+	f     *os.File
 }
 
 func (r *fileStreamer) Initialize() error {
@@ -52,6 +99,9 @@ func (r *fileStreamer) Initialize() error {
 		return err
 	}
 
+	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
+	r.done = make(chan struct{})
+
 	// in a separate routine, route frames from file to ServerStream
 	go r.run()
 
@@ -59,12 +109,129 @@ func (r *fileStreamer) Initialize() error {
 }
 
 func (r *fileStreamer) Close() {
+	r.ctxCancel()
+
+	// interrupt the current read
+	r.mutex.Lock()
+	r.f.Close()
+	r.mutex.Unlock()
+
+	<-r.done
+}
+
+// reopen closes the input and opens it again. Opening a named pipe waits
+// for the next writer, which is interrupted by Close. While the input can't be
+// opened, for instance because a writer is recreating the pipe, it is retried
+// with a backoff. It only fails when the streamer is closed.
+func (r *fileStreamer) reopen() error {
+	r.mutex.Lock()
 	r.f.Close()
+	r.mutex.Unlock()
+
+	delay := reopenDelay
+
+	for {
+		f, err := r.open()
+		if err == nil {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+
+			if r.ctx.Err() != nil {
+				f.Close()
+				return r.ctx.Err()
+			}
+			r.f = f
+
+			return nil
+		}
+
+		if r.ctx.Err() != nil {
+			return r.ctx.Err()
+		}
+
+		log.Printf("failed to reopen %s: %v, retrying in %v", r.pipeName, err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+
+		delay = min(delay*2, reopenMaxDelay)
+	}
+}
+
+// open opens the input. Opening a named pipe waits for a writer, which is
+// interrupted by Close or when the pipe is replaced by a new one.
+func (r *fileStreamer) open() (*os.File, error) {
+	// a non-blocking reader holds the pipe, so that the pending open below can
+	// always be interrupted by opening the same pipe for writing, even after the
+	// path has been removed or points to a new pipe
+	nb, err := os.OpenFile(r.pipeName, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer nb.Close()
+
+	fi, err := nb.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		return os.Open(r.pipeName)
+	}
+
+	held := fmt.Sprintf("/dev/fd/%d", nb.Fd())
+
+	type result struct {
+		f   *os.File
+		err error
+	}
+	res := make(chan result, 1)
+
+	go func() {
+		f, err := os.Open(held)
+		res <- result{f, err}
+	}()
+
+	ticker := time.NewTicker(pipeCheckPeriod)
+	defer ticker.Stop()
+
+	for err == nil {
+		select {
+		case re := <-res:
+			return re.f, re.err
+
+		case <-r.ctx.Done():
+			err = r.ctx.Err()
+
+		case <-ticker.C:
+			// writers that restart may recreate the pipe, which would never be opened
+			cur, err2 := os.Stat(r.pipeName)
+			if err2 != nil || !os.SameFile(fi, cur) {
+				err = fmt.Errorf("the pipe has been replaced")
+			}
+		}
+	}
+
+	// act as a writer to interrupt the pending open
+	w, err2 := os.OpenFile(held, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err2 == nil {
+		w.Close()
+	}
+
+	re := <-res
+	if re.err == nil {
+		re.f.Close()
+	}
+	return nil, err
 }
 
 func (r *fileStreamer) run() {
+	defer close(r.done)
+
 	// setup H264 -> RTP encoder
-	rtpEnc, err := r.stream.Desc.Medias[0].Formats[0].(*format.H264).CreateEncoder()
+	rtpEnc, err := r.out.Stream.Desc.Medias[0].Formats[0].(*format.H264).CreateEncoder()
 	if err != nil {
 		panic(err)
 	}
@@ -80,13 +247,15 @@ func (r *fileStreamer) run() {
 		err = mr.Initialize()
 		// if error is end of file, try to connect again
 		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
 			if errors.Is(err, io.EOF) {
 				log.Printf("file has ended, reconnecting")
 				// close the file and reopen it
-				r.f.Close()
-				r.f, err = os.Open(r.pipeName)
+				err = r.reopen()
 				if err != nil {
-					panic(err)
+					return
 				}
 				continue
 			}
@@ -106,12 +275,22 @@ func (r *fileStreamer) run() {
 		var firstDTS *int64
 		var firstTime time.Time
 		var lastRTPTime uint32
+		randomAccessReceived := false
 
 		// setup a callback that is called when a H264 access unit is read from the file
 		mr.OnDataH264(track, func(pts, dts int64, au [][]byte) error {
 			dts = timeDecoder.Decode(dts)
 			pts = timeDecoder.Decode(pts)
 
+			// skip access units until decoding can start, either from an IDR
+			// or from a recovery point in streams using periodic intra refresh
+			if !randomAccessReceived {
+				if !utils.IsRandomAccessPoint(au) {
+					return nil
+				}
+				randomAccessReceived = true
+			}
+
 			// sleep between access units
 			if firstDTS != nil {
 				timeDrift := time.Duration(dts-*firstDTS)*time.Second/90000 - time.Since(firstTime)
@@ -141,20 +320,18 @@ func (r *fileStreamer) run() {
 			}
 
 			// write RTP packets to the server
-			for _, packet := range packets {
-				err = r.stream.WritePacketRTP(r.stream.Desc.Medias[0], packet)
-				if err != nil {
-					return err
-				}
-			}
-
-			return nil
+			return r.out.WritePackets(packets, utils.IsRandomAccessPoint(au))
 		})
 
 		// read the file
 		for {
 			err = mr.Read()
 			if err != nil {
+				// the streamer has been closed
+				if r.ctx.Err() != nil {
+					return
+				}
+
 				// file has ended
 				if errors.Is(err, io.EOF) {
 					log.Printf("file has ended, rewinding")
@@ -162,7 +339,11 @@ func (r *fileStreamer) run() {
 					// rewind to start position
 					_, err = r.f.Seek(0, io.SeekStart)
 					if err != nil {
-						panic(err)
+						// named pipes can't be rewound, wait for the next writer instead
+						err = r.reopen()
+						if err != nil {
+							return
+						}
 					}
 
 					// keep current timestamp
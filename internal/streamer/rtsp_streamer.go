@@ -0,0 +1,418 @@
+package streamer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"matek-video-streamer/internal/config"
+	"matek-video-streamer/internal/utils"
+	"matek-video-streamer/pkg/source"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+	"github.com/bluenviron/gortsplib/v4/pkg/liberrors"
+	"github.com/pion/rtp"
+)
+
+func init() {
+	source.Register(&source.Source{
+		Name:     "rtsp",
+		Matchers: []source.Matcher{source.MatchScheme("rtsp", "rtsps")},
+		Probe: func(ctx context.Context, address string, settings source.Settings) (*source.Parameters, error) {
+			conf := config.Default()
+			err := settings.Decode(conf)
+			if err != nil {
+				return nil, err
+			}
+
+			params, err := ProbeRTSP(ctx, address, conf.RTSP)
+			if err != nil {
+				return nil, err
+			}
+			return &source.Parameters{SPS: params.SPS, PPS: params.PPS}, nil
+		},
+		New: func(address string, out *source.Output, settings source.Settings) (source.Streamer, error) {
+			conf := config.Default()
+			err := settings.Decode(conf)
+			if err != nil {
+				return nil, err
+			}
+
+			return NewRTSP(out, address, conf.RTSP, conf.PathConf(conf.Path).ForwardSlices()), nil
+		},
+	})
+}
+
+// parseRTSPURL parses the camera address and attaches the configured credentials.
+// Credentials already present in the address take precedence.
+func parseRTSPURL(address string, conf config.RTSPSourceConfig) (*base.URL, error) {
+	u, err := base.ParseURL(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.User == nil && conf.Username != "" {
+		u.User = url.UserPassword(conf.Username, conf.Password)
+	}
+
+	return u, nil
+}
+
+// newRTSPClient creates a client that authenticates with basic or digest
+// authentication, depending on the methods offered by the camera.
+func newRTSPClient(conf config.RTSPSourceConfig) *gortsplib.Client {
+	c := &gortsplib.Client{
+		InitialUDPReadTimeout: time.Duration(conf.UDPTimeout),
+		OnTransportSwitch: func(err error) {
+			log.Printf("RTSP source: %v", err)
+		},
+	}
+
+	// when the transport is nil, UDP is tried first and the client switches
+	// to TCP if no packets are received within InitialUDPReadTimeout
+	switch conf.Transport {
+	case "udp":
+		v := gortsplib.TransportUDP
+		c.Transport = &v
+
+	case "tcp":
+		v := gortsplib.TransportTCP
+		c.Transport = &v
+	}
+
+	return c
+}
+
+// setupRTSP describes the camera stream and sets up the H264 media it provides
+func setupRTSP(c *gortsplib.Client, u *base.URL) (*description.Media, *format.H264, error) {
+	desc, _, err := c.Describe(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var forma *format.H264
+	medi := desc.FindFormat(&forma)
+	if medi == nil {
+		return nil, nil, fmt.Errorf("H264 media not found")
+	}
+
+	_, err = c.Setup(desc.BaseURL, medi, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return medi, forma, nil
+}
+
+// nextDelay doubles a reconnection delay, up to the maximum delay
+func nextDelay(delay time.Duration, conf config.RTSPSourceConfig) time.Duration {
+	return min(delay*2, time.Duration(conf.ReconnectMaxDelay))
+}
+
+// isTemporary checks whether an error of a camera can go away by retrying.
+// Network errors and 5xx status codes are temporary, while errors such as
+// 401 Unauthorized or a missing H264 media need a configuration change.
+func isTemporary(err error) bool {
+	var badStatus liberrors.ErrClientBadStatusCode
+	if errors.As(err, &badStatus) {
+		return badStatus.Code >= base.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// ProbeRTSP reads SPS and PPS from the session description of a RTSP camera.
+// Cameras that only send them in-band return empty parameters.
+// While the camera can't be reached, the probe is retried with the reconnection backoff,
+// until ctx is canceled. Other errors are returned immediately.
+func ProbeRTSP(ctx context.Context, address string, conf config.RTSPSourceConfig) (*utils.H264Parameters, error) {
+	delay := time.Duration(conf.ReconnectDelay)
+
+	for {
+		params, err := probeRTSP(address, conf)
+		if err == nil {
+			return params, nil
+		}
+		if !isTemporary(err) {
+			return nil, err
+		}
+
+		log.Printf("RTSP source error: %v, retrying in %v", err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		delay = nextDelay(delay, conf)
+	}
+}
+
+func probeRTSP(address string, conf config.RTSPSourceConfig) (*utils.H264Parameters, error) {
+	u, err := parseRTSPURL(address, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newRTSPClient(conf)
+	err = c.Start(u.Scheme, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	desc, _, err := c.Describe(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var forma *format.H264
+	medi := desc.FindFormat(&forma)
+	if medi == nil {
+		return nil, fmt.Errorf("H264 media not found")
+	}
+
+	return &utils.H264Parameters{
+		SPS: forma.SPS,
+		PPS: forma.PPS,
+	}, nil
+}
+
+func NewRTSP(
+	out *source.Output,
+	address string,
+	conf config.RTSPSourceConfig,
+	forwardSlices bool,
+) *rtspStreamer {
+	if address == "" {
+		log.Fatalf("address cannot be empty")
+		return nil
+	}
+	return &rtspStreamer{
+		out:           out,
+		address:       address,
+		conf:          conf,
+		forwardSlices: forwardSlices,
+	}
+}
+
+// rtspStreamer pulls a H264 stream from a RTSP camera and routes it to a ServerStream.
+// When the connection fails, it reconnects with an exponential backoff.
+type rtspStreamer struct {
+	out     *source.Output
+	address string
+	conf    config.RTSPSourceConfig
+	// forwardSlices sends slices as soon as they are received instead of complete access units
+	forwardSlices bool
+
+	ctx         context.Context
+	ctxCancel   func()
+	done        chan struct{}
+	randomStart uint32
+}
+
+func (r *rtspStreamer) Initialize() error {
+	_, err := parseRTSPURL(r.address, r.conf)
+	if err != nil {
+		return err
+	}
+
+	r.randomStart, err = utils.RandUint32()
+	if err != nil {
+		return err
+	}
+
+	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
+	r.done = make(chan struct{})
+
+	// in a separate routine, route frames from the camera to ServerStream
+	go r.run()
+
+	return nil
+}
+
+func (r *rtspStreamer) Close() {
+	r.ctxCancel()
+	<-r.done
+}
+
+func (r *rtspStreamer) run() {
+	defer close(r.done)
+
+	delay := time.Duration(r.conf.ReconnectDelay)
+
+	for {
+		start := time.Now()
+		err := r.runInner()
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		// a connection that stayed up for a while resets the backoff
+		if time.Since(start) > time.Duration(r.conf.ReconnectMaxDelay) {
+			delay = time.Duration(r.conf.ReconnectDelay)
+		}
+
+		log.Printf("RTSP source error: %v, reconnecting in %v", err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return
+		}
+
+		delay = nextDelay(delay, r.conf)
+	}
+}
+
+func (r *rtspStreamer) runInner() error {
+	u, err := parseRTSPURL(r.address, r.conf)
+	if err != nil {
+		return err
+	}
+
+	c := newRTSPClient(r.conf)
+	err = c.Start(u.Scheme, u.Host)
+	if err != nil {
+		return err
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- r.read(c, u)
+	}()
+
+	select {
+	case err = <-readErr:
+		c.Close()
+		return err
+
+	case <-r.ctx.Done():
+		c.Close()
+		<-readErr
+		return r.ctx.Err()
+	}
+}
+
+func (r *rtspStreamer) read(c *gortsplib.Client, u *base.URL) error {
+	medi, forma, err := setupRTSP(c, u)
+	if err != nil {
+		return err
+	}
+
+	// setup H264 -> RTP encoder
+	rtpEnc, err := r.out.Stream.Desc.Medias[0].Formats[0].(*format.H264).CreateEncoder()
+	if err != nil {
+		return err
+	}
+
+	randomAccessReceived := false
+	var lastRTPTime uint32
+
+	if r.forwardSlices {
+		f := &sliceForwarder{
+			rtpEnc: rtpEnc,
+			write:  r.out.WritePackets,
+		}
+
+		// setup a callback that forwards slices as soon as they are received from the camera
+		c.OnPacketRTP(medi, forma, func(pkt *rtp.Packet) {
+			pts, ok := c.PacketPTS2(medi, pkt)
+			if !ok {
+				return
+			}
+
+			// H264 clock rate is the same on both sides, timestamps only need to be offset
+			rtpTime := uint32(int64(r.randomStart) + pts)
+
+			err := f.process(pkt, rtpTime)
+			if err != nil {
+				log.Printf("RTSP source: %v", err)
+			}
+
+			if f.randomAccessReceived {
+				randomAccessReceived = true
+				lastRTPTime = rtpTime
+			}
+		})
+	} else {
+		// setup RTP -> H264 decoder
+		rtpDec, err := forma.CreateDecoder()
+		if err != nil {
+			return err
+		}
+
+		// setup a callback that is called when a RTP packet is received from the camera
+		c.OnPacketRTP(medi, forma, func(pkt *rtp.Packet) {
+			pts, ok := c.PacketPTS2(medi, pkt)
+			if !ok {
+				return
+			}
+
+			au, err := rtpDec.Decode(pkt)
+			if err != nil {
+				if !errors.Is(err, rtph264.ErrMorePacketsNeeded) &&
+					!errors.Is(err, rtph264.ErrNonStartingPacketAndNoPrevious) {
+					log.Printf("RTSP source: %v", err)
+				}
+				return
+			}
+
+			// skip access units until decoding can start
+			if !randomAccessReceived {
+				if !utils.IsRandomAccessPoint(au) {
+					return
+				}
+				randomAccessReceived = true
+			}
+
+			// wrap the access unit into RTP packets
+			packets, err := rtpEnc.Encode(au)
+			if err != nil {
+				log.Printf("RTSP source: %v", err)
+				return
+			}
+
+			// H264 clock rate is the same on both sides, timestamps only need to be offset
+			lastRTPTime = uint32(int64(r.randomStart) + pts)
+			for _, packet := range packets {
+				packet.Timestamp = lastRTPTime
+			}
+
+			// write RTP packets to the server
+			err = r.out.WritePackets(packets, utils.IsRandomAccessPoint(au))
+			if err != nil {
+				log.Printf("RTSP source: %v", err)
+			}
+		})
+	}
+
+	_, err = c.Play(nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("reading from RTSP source %s", u.Host)
+	err = c.Wait()
+
+	// keep timestamps increasing across reconnections
+	if randomAccessReceived {
+		r.randomStart = lastRTPTime + 1
+	}
+
+	return err
+}
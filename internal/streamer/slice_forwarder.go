@@ -0,0 +1,211 @@
+package streamer
+
+import (
+	"fmt"
+	"matek-video-streamer/internal/utils"
+	"slices"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/pion/rtp"
+)
+
+// maxNALUSize is the maximum size of a NAL unit rebuilt from fragments
+const maxNALUSize = 8 * 1024 * 1024
+
+// isVCL checks whether a NAL unit contains a slice
+func isVCL(nalu []byte) bool {
+	typ := h264.NALUType(nalu[0] & 0x1F)
+	return typ >= h264.NALUTypeNonIDR && typ <= h264.NALUTypeIDR
+}
+
+// sliceDepacketizer extracts NAL units from RTP packets as soon as they are complete,
+// while rtph264.Decoder waits for the whole access unit
+type sliceDepacketizer struct {
+	fragment []byte
+	prevSeq  uint16
+}
+
+func (d *sliceDepacketizer) decode(pkt *rtp.Packet) ([][]byte, error) {
+	payload := pkt.Payload
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("empty RTP payload")
+	}
+	typ := h264.NALUType(payload[0] & 0x1F)
+
+	// a fragmented NAL unit can't be completed after a packet loss
+	if d.fragment != nil && (typ != h264.NALUTypeFUA || pkt.SequenceNumber != d.prevSeq+1) {
+		d.fragment = nil
+	}
+	d.prevSeq = pkt.SequenceNumber
+
+	switch typ {
+	case h264.NALUTypeFUA:
+		if len(payload) < 2 {
+			return nil, fmt.Errorf("invalid FU-A packet")
+		}
+
+		start := payload[1]&0x80 != 0
+		end := payload[1]&0x40 != 0
+
+		if start {
+			// rebuild the NAL unit header from the FU indicator and the FU header
+			d.fragment = append([]byte{payload[0]&0xE0 | payload[1]&0x1F}, payload[2:]...)
+		} else {
+			// the beginning of the NAL unit was lost
+			if d.fragment == nil {
+				return nil, nil
+			}
+			d.fragment = append(d.fragment, payload[2:]...)
+		}
+
+		if len(d.fragment) > maxNALUSize {
+			d.fragment = nil
+			return nil, fmt.Errorf("NAL unit is too big")
+		}
+
+		if !end {
+			return nil, nil
+		}
+
+		nalu := d.fragment
+		d.fragment = nil
+		return [][]byte{nalu}, nil
+
+	case h264.NALUTypeSTAPA:
+		var nalus [][]byte
+		payload = payload[1:]
+
+		for len(payload) > 0 {
+			if len(payload) < 2 {
+				return nil, fmt.Errorf("invalid STAP-A packet")
+			}
+			size := int(payload[0])<<8 | int(payload[1])
+			payload = payload[2:]
+
+			if size == 0 || size > len(payload) {
+				return nil, fmt.Errorf("invalid STAP-A packet")
+			}
+			nalus = append(nalus, payload[:size])
+			payload = payload[size:]
+		}
+
+		return nalus, nil
+
+	case h264.NALUTypeSTAPB, h264.NALUTypeMTAP16, h264.NALUTypeMTAP24, h264.NALUTypeFUB:
+		return nil, fmt.Errorf("packet type %d is not supported", typ)
+	}
+
+	return [][]byte{payload}, nil
+}
+
+// sliceForwarder sends each slice of an access unit as soon as it is received, instead of
+// waiting for the complete access unit. With encoders that split frames into multiple slices,
+// this saves up to one frame of latency. Non-VCL NAL units are sent together with the slice
+// that follows them, and the marker bit is only set on the last packet of the access unit.
+// Access units starting with a non-IDR I slice are sent once complete, see send.
+type sliceForwarder struct {
+	rtpEnc *rtph264.Encoder
+	write  func(packets []*rtp.Packet, randomAccess bool) error
+
+	depacketizer sliceDepacketizer
+	// non-VCL NAL units waiting for the next slice
+	pending [][]byte
+	// whether part of the current access unit has been handled
+	auStarted bool
+	// NAL units of the current access unit held back until it is complete
+	held                 [][]byte
+	holding              bool
+	prevTimestamp        uint32
+	randomAccessReceived bool
+}
+
+// process handles a RTP packet of the source. timestamp is the timestamp of the outgoing packets.
+func (f *sliceForwarder) process(pkt *rtp.Packet, timestamp uint32) error {
+	// the end of the previous access unit was lost
+	if f.auStarted && pkt.Timestamp != f.prevTimestamp {
+		f.auStarted = false
+		f.pending = nil
+		f.held = nil
+		f.holding = false
+	}
+	f.prevTimestamp = pkt.Timestamp
+
+	nalus, err := f.depacketizer.decode(pkt)
+	if err != nil {
+		return err
+	}
+
+	for i, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		end := pkt.Marker && i == len(nalus)-1
+
+		f.pending = append(f.pending, nalu)
+		if !isVCL(nalu) && !end {
+			continue
+		}
+
+		group := f.pending
+		f.pending = nil
+
+		err = f.send(group, timestamp, end)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *sliceForwarder) send(group [][]byte, timestamp uint32, end bool) error {
+	first := !f.auStarted
+	f.auStarted = !end
+
+	// an IDR slice or a recovery point makes the access unit a random access point from its
+	// first slice. An access unit starting with an I slice is one only if all its slices are,
+	// which is known once it is complete, so it is held back until then.
+	randomAccess := false
+	if first {
+		if utils.HasRandomAccessNALU(group) {
+			randomAccess = true
+		} else if slices.ContainsFunc(group, utils.IsIntraSlice) {
+			f.holding = true
+		}
+	}
+
+	if f.holding {
+		f.held = append(f.held, group...)
+		if !end {
+			return nil
+		}
+
+		group = f.held
+		f.held = nil
+		f.holding = false
+		randomAccess = utils.IsRandomAccessPoint(group)
+	}
+
+	// skip access units until decoding can start
+	if !f.randomAccessReceived {
+		if !randomAccess {
+			return nil
+		}
+		f.randomAccessReceived = true
+	}
+
+	// wrap the NAL units into RTP packets
+	packets, err := f.rtpEnc.Encode(group)
+	if err != nil {
+		return err
+	}
+
+	for _, packet := range packets {
+		packet.Timestamp = timestamp
+		packet.Marker = false
+	}
+	packets[len(packets)-1].Marker = end
+
+	return f.write(packets, randomAccess)
+}
@@ -0,0 +1,263 @@
+package streamer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+	"github.com/pion/rtp"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02, 0x27, 0xe5, 0x84, 0x00}
+	testPPS = []byte{0x68, 0xcb, 0x83, 0xcb, 0x20}
+	testSEI = []byte{0x06, 0x01, 0x01, 0x00, 0x80}
+	// IDR slices starting at macroblock 0 and 10
+	testIDR1 = append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0x11}, 300)...)
+	testIDR2 = append([]byte{0x65, 0x16, 0x60}, bytes.Repeat([]byte{0x22}, 300)...)
+	// non-IDR I slices starting at macroblock 0 and 10
+	testI1 = append([]byte{0x41, 0x88}, bytes.Repeat([]byte{0x55}, 300)...)
+	testI2 = append([]byte{0x41, 0x16, 0x22}, bytes.Repeat([]byte{0x66}, 300)...)
+	// P slices starting at macroblock 0 and 10
+	testP1 = append([]byte{0x41, 0x98}, bytes.Repeat([]byte{0x33}, 50)...)
+	testP2 = append([]byte{0x41, 0x16, 0x60}, bytes.Repeat([]byte{0x44}, 50)...)
+)
+
+// testSource generates the RTP packets of a camera
+type testSource struct {
+	seq uint16
+}
+
+func (s *testSource) packet(ts uint32, marker bool, payload []byte) *rtp.Packet {
+	s.seq++
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    96,
+			SequenceNumber: s.seq,
+			Timestamp:      ts,
+			Marker:         marker,
+		},
+		Payload: payload,
+	}
+}
+
+func (s *testSource) single(ts uint32, marker bool, nalu []byte) *rtp.Packet {
+	return s.packet(ts, marker, nalu)
+}
+
+func (s *testSource) stapA(ts uint32, marker bool, nalus ...[]byte) *rtp.Packet {
+	payload := []byte{0x18}
+	for _, nalu := range nalus {
+		payload = append(payload, byte(len(nalu)>>8), byte(len(nalu)))
+		payload = append(payload, nalu...)
+	}
+	return s.packet(ts, marker, payload)
+}
+
+// fuA splits a NAL unit into n FU-A packets, the last of which carries marker
+func (s *testSource) fuA(ts uint32, marker bool, nalu []byte, n int) []*rtp.Packet {
+	body := nalu[1:]
+	size := (len(body) + n - 1) / n
+
+	var packets []*rtp.Packet
+	for i := 0; i < n; i++ {
+		header := nalu[0] & 0x1F
+		if i == 0 {
+			header |= 0x80
+		}
+		if i == n-1 {
+			header |= 0x40
+		}
+
+		part := body[i*size : min((i+1)*size, len(body))]
+		payload := append([]byte{nalu[0]&0xE0 | 28, header}, part...)
+		packets = append(packets, s.packet(ts, marker && i == n-1, payload))
+	}
+	return packets
+}
+
+type testWrite struct {
+	packets      []*rtp.Packet
+	randomAccess bool
+}
+
+func newTestForwarder(t *testing.T) (*sliceForwarder, *[]testWrite) {
+	rtpEnc := &rtph264.Encoder{
+		PayloadType:       96,
+		PacketizationMode: 1,
+		PayloadMaxSize:    100,
+	}
+	err := rtpEnc.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var writes []testWrite
+	f := &sliceForwarder{
+		rtpEnc: rtpEnc,
+		write: func(packets []*rtp.Packet, randomAccess bool) error {
+			writes = append(writes, testWrite{packets, randomAccess})
+			return nil
+		},
+	}
+	return f, &writes
+}
+
+func process(t *testing.T, f *sliceForwarder, timestamp uint32, packets ...*rtp.Packet) {
+	for _, pkt := range packets {
+		err := f.process(pkt, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkWrite checks the NAL units of a write, the marker and the timestamp of its packets
+func checkWrite(t *testing.T, w testWrite, timestamp uint32, randomAccess bool, end bool, nalus ...[]byte) {
+	t.Helper()
+
+	if w.randomAccess != randomAccess {
+		t.Errorf("randomAccess = %v, want %v", w.randomAccess, randomAccess)
+	}
+
+	var d sliceDepacketizer
+	var got [][]byte
+	for i, pkt := range w.packets {
+		if pkt.Timestamp != timestamp {
+			t.Errorf("packet %d: timestamp = %d, want %d", i, pkt.Timestamp, timestamp)
+		}
+		if want := end && i == len(w.packets)-1; pkt.Marker != want {
+			t.Errorf("packet %d: marker = %v, want %v", i, pkt.Marker, want)
+		}
+
+		decoded, err := d.decode(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, decoded...)
+	}
+
+	if len(got) != len(nalus) {
+		t.Fatalf("got %d NAL units, want %d", len(got), len(nalus))
+	}
+	for i := range nalus {
+		if !bytes.Equal(got[i], nalus[i]) {
+			t.Errorf("NAL unit %d differs", i)
+		}
+	}
+}
+
+func TestSliceForwarderMultiSlice(t *testing.T) {
+	f, writes := newTestForwarder(t)
+	var s testSource
+
+	// IDR access unit: parameters and the first slice aggregated, the second slice fragmented
+	process(t, f, 1000, s.stapA(90000, false, testSPS, testPPS, testIDR1))
+	process(t, f, 1000, s.fuA(90000, true, testIDR2, 3)...)
+
+	// non-IDR access unit made of two slices
+	process(t, f, 4000, s.single(93000, false, testP1))
+	process(t, f, 4000, s.single(93000, true, testP2))
+
+	if len(*writes) != 4 {
+		t.Fatalf("got %d writes, want 4", len(*writes))
+	}
+	checkWrite(t, (*writes)[0], 1000, true, false, testSPS, testPPS, testIDR1)
+	checkWrite(t, (*writes)[1], 1000, false, true, testIDR2)
+	checkWrite(t, (*writes)[2], 4000, false, false, testP1)
+	checkWrite(t, (*writes)[3], 4000, false, true, testP2)
+}
+
+func TestSliceForwarderWaitRandomAccess(t *testing.T) {
+	f, writes := newTestForwarder(t)
+	var s testSource
+
+	// decoding can't start from a P slice
+	process(t, f, 1000, s.single(90000, false, testP1))
+	process(t, f, 1000, s.single(90000, true, testP2))
+
+	process(t, f, 4000, s.stapA(93000, false, testSPS, testPPS, testIDR1))
+	process(t, f, 4000, s.single(93000, true, testIDR2))
+
+	if len(*writes) != 2 {
+		t.Fatalf("got %d writes, want 2", len(*writes))
+	}
+	checkWrite(t, (*writes)[0], 4000, true, false, testSPS, testPPS, testIDR1)
+	checkWrite(t, (*writes)[1], 4000, false, true, testIDR2)
+}
+
+func TestSliceForwarderLostFragment(t *testing.T) {
+	f, writes := newTestForwarder(t)
+	var s testSource
+
+	process(t, f, 1000, s.stapA(90000, false, testSPS, testPPS, testIDR1))
+
+	// the middle fragment of the second slice is lost, together with the end of the access unit
+	fragments := s.fuA(90000, true, testIDR2, 3)
+	process(t, f, 1000, fragments[0], fragments[2])
+
+	// the next access unit is still recognized as the start of one
+	process(t, f, 4000, s.stapA(93000, false, testSPS, testPPS, testIDR1))
+	process(t, f, 4000, s.single(93000, true, testIDR2))
+
+	if len(*writes) != 3 {
+		t.Fatalf("got %d writes, want 3", len(*writes))
+	}
+	checkWrite(t, (*writes)[0], 1000, true, false, testSPS, testPPS, testIDR1)
+	checkWrite(t, (*writes)[1], 4000, true, false, testSPS, testPPS, testIDR1)
+	checkWrite(t, (*writes)[2], 4000, false, true, testIDR2)
+}
+
+func TestSliceForwarderLostMarker(t *testing.T) {
+	f, writes := newTestForwarder(t)
+	var s testSource
+
+	process(t, f, 1000, s.stapA(90000, false, testSPS, testPPS, testIDR1))
+	process(t, f, 1000, s.single(90000, true, testIDR2))
+
+	// the packet carrying the marker is lost, after a SEI waiting for the next slice
+	process(t, f, 4000, s.single(93000, false, testP1))
+	process(t, f, 4000, s.single(93000, false, testSEI))
+	s.single(93000, true, testP2)
+
+	// the SEI of the previous access unit is not sent with the next one
+	process(t, f, 7000, s.single(96000, false, testP1))
+	process(t, f, 7000, s.single(96000, true, testP2))
+
+	if len(*writes) != 5 {
+		t.Fatalf("got %d writes, want 5", len(*writes))
+	}
+	checkWrite(t, (*writes)[2], 4000, false, false, testP1)
+	checkWrite(t, (*writes)[3], 7000, false, false, testP1)
+	checkWrite(t, (*writes)[4], 7000, false, true, testP2)
+}
+
+func TestSliceForwarderIntraSlices(t *testing.T) {
+	f, writes := newTestForwarder(t)
+	var s testSource
+
+	// an I slice followed by a P slice is not a random access point
+	process(t, f, 1000, s.stapA(90000, false, testSPS, testPPS, testI1))
+	process(t, f, 1000, s.single(90000, true, testP2))
+
+	// access units starting with an I slice are sent once complete,
+	// as random access points only if all their slices are intra
+	process(t, f, 4000, s.stapA(93000, false, testSPS, testPPS, testI1))
+	process(t, f, 4000, s.fuA(93000, true, testI2, 3)...)
+
+	process(t, f, 7000, s.single(96000, false, testI1))
+	process(t, f, 7000, s.single(96000, true, testP2))
+
+	// access units starting with a P slice are still sent slice by slice
+	process(t, f, 10000, s.single(99000, false, testP1))
+	process(t, f, 10000, s.single(99000, true, testP2))
+
+	if len(*writes) != 4 {
+		t.Fatalf("got %d writes, want 4", len(*writes))
+	}
+	checkWrite(t, (*writes)[0], 4000, true, true, testSPS, testPPS, testI1, testI2)
+	checkWrite(t, (*writes)[1], 7000, false, true, testI1, testP2)
+	checkWrite(t, (*writes)[2], 10000, false, false, testP1)
+	checkWrite(t, (*writes)[3], 10000, false, true, testP2)
+}
@@ -1,6 +1,18 @@
 package utils
 
-import "os"
+import (
+	"os"
+	"syscall"
+)
+
+func CreatePipe(pipeName string) error {
+	// recreate the named pipe to drop data left by a previous writer
+	err := RemovePipe(pipeName)
+	if err != nil {
+		return err
+	}
+	return syscall.Mkfifo(pipeName, 0o644)
+}
 
 func RemovePipe(pipeName string) error {
 	// remove the named pipe if it exists
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+)
+
+// seiPayloadTypeRecoveryPoint is the SEI payload type of a recovery point message
+const seiPayloadTypeRecoveryPoint = 6
+
+// IsRandomAccessPoint checks whether decoding can start from the given access unit.
+// Besides IDR frames, access units carrying a recovery point SEI are accepted, since
+// encoders using periodic intra refresh never emit IDR frames after the first one,
+// and so are access units made of I slices only, which some encoders use instead of IDR frames.
+func IsRandomAccessPoint(au [][]byte) bool {
+	if HasRandomAccessNALU(au) {
+		return true
+	}
+
+	slices := 0
+	intraSlices := 0
+
+	for _, nalu := range au {
+		if len(nalu) != 0 && h264.NALUType(nalu[0]&0x1F) == h264.NALUTypeNonIDR {
+			slices++
+			if IsIntraSlice(nalu) {
+				intraSlices++
+			}
+		}
+	}
+
+	return slices != 0 && intraSlices == slices
+}
+
+// HasRandomAccessNALU checks whether NAL units include an IDR slice or a recovery point SEI,
+// either of which makes the access unit they belong to a random access point, whatever its other NAL units
+func HasRandomAccessNALU(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeIDR:
+			return true
+
+		case h264.NALUTypeSEI:
+			if HasRecoveryPointSEI(nalu) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsIntraSlice checks whether a NAL unit contains an I or SI slice
+func IsIntraSlice(nalu []byte) bool {
+	typ := h264.NALUType(nalu[0] & 0x1F)
+	if typ != h264.NALUTypeNonIDR && typ != h264.NALUTypeIDR {
+		return false
+	}
+
+	// the slice header starts with first_mb_in_slice and slice_type, both coded as ue(v).
+	// A few bytes are enough to read them.
+	header := nalu[1:]
+	if len(header) > 16 {
+		header = header[:16]
+	}
+	r := &bitReader{buf: h264.EmulationPreventionRemove(header)}
+
+	_, ok := r.readUE()
+	if !ok {
+		return false
+	}
+	sliceType, ok := r.readUE()
+	if !ok {
+		return false
+	}
+
+	// types 5 to 9 are the same as 0 to 4, with all the slices of the picture sharing the type
+	switch sliceType % 5 {
+	case 2, 4: // I, SI
+		return true
+	}
+	return false
+}
+
+// bitReader reads Exp-Golomb coded values
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *bitReader) readBit() (uint32, bool) {
+	if r.pos >= len(r.buf)*8 {
+		return 0, false
+	}
+	bit := uint32(r.buf[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return bit, true
+}
+
+func (r *bitReader) readUE() (uint32, bool) {
+	leadingZeros := 0
+	for {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		if bit == 1 {
+			break
+		}
+		leadingZeros++
+		if leadingZeros > 31 {
+			return 0, false
+		}
+	}
+
+	v := uint32(0)
+	for i := 0; i < leadingZeros; i++ {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		v = v<<1 | bit
+	}
+
+	return 1<<leadingZeros - 1 + v, true
+}
+
+// HasRecoveryPointSEI checks whether a SEI NAL unit contains a recovery point message
+func HasRecoveryPointSEI(nalu []byte) bool {
+	if len(nalu) < 2 || h264.NALUType(nalu[0]&0x1F) != h264.NALUTypeSEI {
+		return false
+	}
+
+	buf := h264.EmulationPreventionRemove(nalu[1:])
+	pos := 0
+
+	// a SEI NAL unit can carry multiple messages, each one prefixed by
+	// its type and size, both coded as a sequence of 0xFF bytes plus a final byte.
+	// Messages are followed by the RBSP trailing bits, a single 0x80 byte.
+	for pos < len(buf) && !(pos == len(buf)-1 && buf[pos] == 0x80) {
+		payloadType := 0
+		for pos < len(buf) && buf[pos] == 0xFF {
+			payloadType += 255
+			pos++
+		}
+		if pos >= len(buf) {
+			return false
+		}
+		payloadType += int(buf[pos])
+		pos++
+
+		payloadSize := 0
+		for pos < len(buf) && buf[pos] == 0xFF {
+			payloadSize += 255
+			pos++
+		}
+		if pos >= len(buf) {
+			return false
+		}
+		payloadSize += int(buf[pos])
+		pos++
+
+		if payloadType == seiPayloadTypeRecoveryPoint {
+			return true
+		}
+
+		pos += payloadSize
+	}
+
+	return false
+}
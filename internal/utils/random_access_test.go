@@ -0,0 +1,161 @@
+package utils
+
+import "testing"
+
+// x264 user data unregistered UUID
+var x264UUID = []byte{
+	0xdc, 0x45, 0xe9, 0xbd, 0xe6, 0xd9, 0x48, 0xb7,
+	0x96, 0x2c, 0xd8, 0x20, 0xd9, 0x23, 0xee, 0xef,
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func TestHasRecoveryPointSEI(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		nalu []byte
+		want bool
+	}{
+		{
+			"recovery point",
+			// recovery_frame_cnt=0, exact_match_flag=1, broken_link_flag=0, changing_slice_group_idc=0
+			[]byte{0x06, 0x06, 0x01, 0xc4, 0x80},
+			true,
+		},
+		{
+			"picture timing with emulation prevention",
+			[]byte{0x06, 0x01, 0x04, 0x00, 0x00, 0x03, 0x00, 0x00, 0x80},
+			false,
+		},
+		{
+			"user data then recovery point",
+			concat([]byte{0x06, 0x05, 0x14}, x264UUID, []byte("x264"), []byte{0x06, 0x01, 0xc4, 0x80}),
+			true,
+		},
+		{
+			// the user data payload is 00 00 01, which is escaped in the NAL unit.
+			// The payload size counts unescaped bytes.
+			"user data with emulation prevention then recovery point",
+			concat([]byte{0x06, 0x05, 0x13}, x264UUID, []byte{0x00, 0x00, 0x03, 0x01, 0x06, 0x01, 0xc4, 0x80}),
+			true,
+		},
+		{
+			"payload type 128 then recovery point",
+			[]byte{0x06, 0x80, 0x01, 0x00, 0x06, 0x01, 0xc4, 0x80},
+			true,
+		},
+		{
+			"extended payload type 261",
+			[]byte{0x06, 0xff, 0x06, 0x01, 0x00, 0x80},
+			false,
+		},
+		{
+			"truncated message",
+			[]byte{0x06, 0x06},
+			false,
+		},
+		{
+			"not a SEI",
+			[]byte{0x65, 0x88, 0x80},
+			false,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			if got := HasRecoveryPointSEI(ca.nalu); got != ca.want {
+				t.Errorf("got %v, want %v", got, ca.want)
+			}
+		})
+	}
+}
+
+var (
+	spsNALU = []byte{0x67, 0x42, 0xc0, 0x1e}
+	ppsNALU = []byte{0x68, 0xce, 0x3c, 0x80}
+	idrNALU = []byte{0x65, 0x88, 0x80}
+	// first_mb_in_slice=0, slice_type=7 (I)
+	iSliceNALU = []byte{0x41, 0x88, 0x80}
+	// first_mb_in_slice=1, slice_type=7 (I)
+	iSliceNALU2 = []byte{0x41, 0x42, 0x00, 0x80}
+	// first_mb_in_slice=0, slice_type=2 (I)
+	iSliceNALU3 = []byte{0x41, 0xb0}
+	// first_mb_in_slice=0, slice_type=5 (P)
+	pSliceNALU = []byte{0x41, 0x98}
+	// first_mb_in_slice=0, slice_type=0 (P)
+	pSliceNALU2 = []byte{0x41, 0xc0}
+	// first_mb_in_slice=0, slice_type=1 (B)
+	bSliceNALU = []byte{0x01, 0xa0}
+	// recovery point SEI
+	recoveryNALU = []byte{0x06, 0x06, 0x01, 0xc4, 0x80}
+)
+
+func TestIsIntraSlice(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		nalu []byte
+		want bool
+	}{
+		{"I slice, type 7", iSliceNALU, true},
+		{"I slice, second slice of the picture", iSliceNALU2, true},
+		{"I slice, type 2", iSliceNALU3, true},
+		{"IDR slice", idrNALU, true},
+		{"P slice, type 5", pSliceNALU, false},
+		{"P slice, type 0", pSliceNALU2, false},
+		{"B slice", bSliceNALU, false},
+		{"truncated header", []byte{0x41, 0x00}, false},
+		{"SPS", spsNALU, false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			if got := IsIntraSlice(ca.nalu); got != ca.want {
+				t.Errorf("got %v, want %v", got, ca.want)
+			}
+		})
+	}
+}
+
+func TestIsRandomAccessPoint(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		au   [][]byte
+		want bool
+	}{
+		{"IDR", [][]byte{spsNALU, ppsNALU, idrNALU}, true},
+		{"recovery point", [][]byte{recoveryNALU, pSliceNALU}, true},
+		{"I slices", [][]byte{spsNALU, ppsNALU, iSliceNALU, iSliceNALU2}, true},
+		{"I and P slices", [][]byte{iSliceNALU, pSliceNALU}, false},
+		{"P slice", [][]byte{pSliceNALU}, false},
+		{"parameters only", [][]byte{spsNALU, ppsNALU}, false},
+		{"empty NAL units", [][]byte{{}, iSliceNALU}, true},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			if got := IsRandomAccessPoint(ca.au); got != ca.want {
+				t.Errorf("got %v, want %v", got, ca.want)
+			}
+		})
+	}
+}
+
+func TestHasRandomAccessNALU(t *testing.T) {
+	for _, ca := range []struct {
+		name  string
+		nalus [][]byte
+		want  bool
+	}{
+		{"IDR", [][]byte{spsNALU, ppsNALU, idrNALU}, true},
+		{"recovery point", [][]byte{recoveryNALU, pSliceNALU}, true},
+		// the other slices of the access unit may not be intra
+		{"I slice", [][]byte{spsNALU, ppsNALU, iSliceNALU}, false},
+		{"P slice", [][]byte{pSliceNALU}, false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			if got := HasRandomAccessNALU(ca.nalus); got != ca.want {
+				t.Errorf("got %v, want %v", got, ca.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Recorder runs FFmpeg to save a RTSP stream into MPEG-TS segments, without re-encoding.
+// Segments are named after the time they start at. FFmpeg is restarted whenever it exits.
+type Recorder struct {
+	// Source is the URL of the RTSP stream to read
+	Source string
+	// Dir is the directory segments are written to
+	Dir string
+	// Name is the prefix of the segment file names
+	Name string
+	// SegmentDuration is the duration of each segment
+	SegmentDuration time.Duration
+
+	ctx       context.Context
+	ctxCancel func()
+	done      chan struct{}
+}
+
+func (r *Recorder) Initialize() error {
+	err := os.MkdirAll(r.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
+	r.done = make(chan struct{})
+
+	go r.run()
+
+	return nil
+}
+
+func (r *Recorder) Close() {
+	r.ctxCancel()
+	<-r.done
+}
+
+func (r *Recorder) args() []string {
+	return []string{
+		"-loglevel", "error",
+		"-rtsp_transport", "tcp", // Avoid packet loss on the loopback
+		"-i", r.Source, // Input stream
+		"-c", "copy", // Keep the original encoding
+		"-f", "segment",
+		"-segment_format", "mpegts",
+		"-segment_time", strconv.FormatFloat(r.SegmentDuration.Seconds(), 'f', -1, 64),
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		filepath.Join(r.Dir, r.Name+"_%Y-%m-%d_%H-%M-%S.ts"),
+	}
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	superviseFFmpeg(r.ctx, "recorder of "+redactURL(r.Source), r.args)
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ffmpegRestartDelay is the delay before FFmpeg is restarted after exiting
+const ffmpegRestartDelay = 2 * time.Second
+
+// Transcoder runs FFmpeg to re-encode a RTSP stream into a MPEG-TS named pipe.
+// FFmpeg is restarted whenever it exits, for instance when the reader of the pipe goes away.
+type Transcoder struct {
+	// Source is the URL of the RTSP stream to read
+	Source string
+	// Output is the named pipe the MPEG-TS stream is written to
+	Output string
+	// Params are the encoder settings, Keyint is used as GOP length
+	Params EncoderParams
+	// FPS is the output frame rate. When zero, the input frame rate is kept.
+	FPS int
+
+	ctx       context.Context
+	ctxCancel func()
+	done      chan struct{}
+}
+
+func (t *Transcoder) Initialize() error {
+	err := t.Params.Validate()
+	if err != nil {
+		return err
+	}
+
+	t.ctx, t.ctxCancel = context.WithCancel(context.Background())
+	t.done = make(chan struct{})
+
+	go t.run()
+
+	return nil
+}
+
+func (t *Transcoder) Close() {
+	t.ctxCancel()
+	<-t.done
+}
+
+func (t *Transcoder) args() []string {
+	args := []string{
+		"-loglevel", "error",
+		"-rtsp_transport", "tcp", // Avoid packet loss on the loopback
+		"-i", t.Source, // Input stream
+		"-an", // Drop audio
+	}
+
+	var filters []string
+	if t.Params.Resolution != "" {
+		filters = append(filters, "scale="+strings.Replace(t.Params.Resolution, "x", ":", 1))
+	}
+	if t.FPS > 0 {
+		filters = append(filters, "fps="+strconv.Itoa(t.FPS))
+	}
+	if len(filters) != 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+
+	args = append(args, t.Params.ffmpegArgs()...)
+
+	return append(args,
+		"-f", "mpegts",
+		"-y",
+		t.Output,
+	)
+}
+
+func (t *Transcoder) run() {
+	defer close(t.done)
+	superviseFFmpeg(t.ctx, "transcoder of "+redactURL(t.Source), t.args)
+}
+
+// superviseFFmpeg runs FFmpeg until the context is canceled, restarting it whenever it exits
+func superviseFFmpeg(ctx context.Context, name string, args func() []string) {
+	for {
+		cmd := exec.CommandContext(ctx, "ffmpeg", args()...)
+		output, err := cmd.CombinedOutput()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Printf("%s exited: %v %s", name, err, strings.TrimSpace(string(output)))
+		} else {
+			log.Printf("%s exited", name)
+		}
+
+		select {
+		case <-time.After(ffmpegRestartDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// redactURL hides the password of a URL, so that it can be logged
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/hex"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
@@ -535,16 +537,129 @@ func parseH264Parameters(data []byte) (*H264Parameters, error) {
 	return params, nil
 }
 
-func MP4ToTS(inputPath, outputPath string) error {
+// EncoderParams holds the H.264 encoder settings used when converting files
+type EncoderParams struct {
+	// Keyint is the keyframe interval in frames. Shorter GOPs lower the
+	// startup latency of readers at the cost of a higher bitrate.
+	Keyint int `json:"keyint"`
+	// Bitrate is the target video bitrate in FFmpeg notation (e.g. "2M").
+	// When empty, the encoder default rate control is used.
+	Bitrate string `json:"bitrate"`
+	// Preset is the x264 preset (ultrafast, superfast, veryfast, ...)
+	Preset string `json:"preset"`
+	// Resolution is the output size as WIDTHxHEIGHT. When empty, the input size is kept.
+	Resolution string `json:"resolution"`
+}
+
+// DefaultEncoderParams returns the low latency settings used by default
+func DefaultEncoderParams() EncoderParams {
+	return EncoderParams{
+		Keyint: 30,
+		Preset: "ultrafast",
+	}
+}
+
+// Validate checks that the encoder settings can be passed to FFmpeg
+func (p EncoderParams) Validate() error {
+	if p.Keyint <= 0 {
+		return fmt.Errorf("invalid keyint: %d", p.Keyint)
+	}
+
+	if p.Preset == "" {
+		return fmt.Errorf("preset cannot be empty")
+	}
+
+	if p.Resolution != "" {
+		_, _, err := parseResolution(p.Resolution)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseResolution parses a WIDTHxHEIGHT size, such as 1280x720
+func parseResolution(s string) (int, int, error) {
+	ws, hs, ok := strings.Cut(s, "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid resolution: %s", s)
+	}
+
+	width, err := parseDimension(ws)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid resolution: %s", s)
+	}
+	height, err := parseDimension(hs)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid resolution: %s", s)
+	}
+
+	return width, height, nil
+}
+
+// parseDimension parses a positive number of pixels, without signs, spaces or leading zeros
+func parseDimension(s string) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if v <= 0 || strconv.Itoa(v) != s {
+		return 0, fmt.Errorf("invalid dimension: %s", s)
+	}
+	return v, nil
+}
+
+// ffmpegArgs returns the FFmpeg arguments that re-encode video with x264 using the parameters.
+// The resolution is not included, since it is applied differently depending on the input.
+func (p EncoderParams) ffmpegArgs() []string {
+	keyint := strconv.Itoa(p.Keyint)
+
+	args := []string{
+		"-c:v", "libx264", // Re-encode video to ensure proper frame order
+		"-preset", p.Preset, // Encoding speed
+		"-tune", "zerolatency", // Low latency tuning
+		"-x264-params", "keyint=" + keyint + ":min-keyint=" + keyint, // Force keyframes every keyint frames
+	}
+
+	if p.Bitrate != "" {
+		args = append(args,
+			"-b:v", p.Bitrate, // Target bitrate
+			"-maxrate", p.Bitrate, // Cap bitrate peaks
+			"-bufsize", p.Bitrate, // Rate control buffer of about one second
+		)
+	}
+
+	return args
+}
+
+func MP4ToTS(inputPath, outputPath string, params EncoderParams) error {
+	return MP4ToTSWithProgress(inputPath, outputPath, params, nil)
+}
+
+// MP4ToTSWithProgress works like MP4ToTS and calls onProgress with the position
+// of the encoder in the input, as reported by FFmpeg. onProgress can be nil.
+func MP4ToTSWithProgress(inputPath, outputPath string, params EncoderParams, onProgress func(time.Duration)) error {
+	err := params.Validate()
+	if err != nil {
+		return err
+	}
+
 	// Build FFmpeg command with additional parameters to ensure SPS/PPS are included
 	// and force the first frame to be an IDR frame
-	cmd := exec.Command("ffmpeg",
+	args := []string{
 		"-i", inputPath, // Input file
-		"-c:v", "libx264", // Re-encode video to ensure proper frame order
-		"-preset", "ultrafast", // Fast encoding
-		"-tune", "zerolatency", // Low latency tuning
-		"-x264-params", "keyint=30:min-keyint=30", // Force keyframes every 30 frames
+	}
+	args = append(args, params.ffmpegArgs()...)
+	args = append(args,
 		"-force_key_frames", "expr:gte(t,0)", // Force a keyframe at the start
+	)
+
+	if params.Resolution != "" {
+		args = append(args, "-s", params.Resolution) // Output size
+	}
+
+	args = append(args,
 		"-bsf:v", "h264_mp4toannexb", // Convert H.264 bitstream from MP4 to Annex B format
 		"-avoid_negative_ts", "make_zero", // Avoid negative timestamps
 		"-fflags", "+genpts", // Generate presentation timestamps
@@ -553,11 +668,80 @@ func MP4ToTS(inputPath, outputPath string) error {
 		outputPath, // Output file
 	)
 
+	if onProgress != nil {
+		args = append([]string{
+			"-progress", "pipe:1", // Write progress to stdout
+			"-nostats", // Keep stderr for errors
+		}, args...)
+	}
+
+	cmd := exec.Command("ffmpeg", args...)
+
+	var output bytes.Buffer
+	cmd.Stderr = &output
+
 	// Run the command
-	output, err := cmd.CombinedOutput()
+	if onProgress == nil {
+		cmd.Stdout = &output
+		err = cmd.Run()
+	} else {
+		err = runWithProgress(cmd, onProgress)
+	}
 	if err != nil {
-		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, string(output))
+		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, output.String())
 	}
 
 	return nil
 }
+
+// runWithProgress runs FFmpeg and parses the key=value progress lines it writes to stdout
+func runWithProgress(cmd *exec.Cmd, onProgress func(time.Duration)) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "out_time_us=")
+		if !ok {
+			continue
+		}
+
+		// the value is N/A until the first frame is written
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && us >= 0 {
+			onProgress(time.Duration(us) * time.Microsecond)
+		}
+	}
+
+	// drain the pipe, so that FFmpeg doesn't block if scanning stopped early
+	io.Copy(io.Discard, stdout)
+
+	return cmd.Wait()
+}
+
+// MediaDuration returns the duration of a media file, as reported by ffprobe
+func MediaDuration(path string) (time.Duration, error) {
+	output, err := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe error: %v", err)
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %s", strings.TrimSpace(string(output)))
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,35 @@
+package utils
+
+import "testing"
+
+func TestEncoderParamsValidateResolution(t *testing.T) {
+	for _, ca := range []struct {
+		resolution string
+		valid      bool
+	}{
+		{"", true},
+		{"1280x720", true},
+		{"640x360", true},
+		{"1280x720abc", false},
+		{"1280x720x480", false},
+		{"abc1280x720", false},
+		{"1280 x720", false},
+		{"1280x 720", false},
+		{"1280x", false},
+		{"x720", false},
+		{"1280", false},
+		{"0x720", false},
+		{"1280x-720", false},
+		{"+1280x720", false},
+		{"01280x720", false},
+		{"1280X720", false},
+	} {
+		t.Run(ca.resolution, func(t *testing.T) {
+			p := EncoderParams{Keyint: 30, Preset: "ultrafast", Resolution: ca.resolution}
+			err := p.Validate()
+			if (err == nil) != ca.valid {
+				t.Errorf("Validate() = %v, want valid=%v", err, ca.valid)
+			}
+		})
+	}
+}
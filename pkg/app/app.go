@@ -0,0 +1,353 @@
+// Package app contains the command line interface of the streamer.
+// Programs embedding the streamer run it after registering their own sources.
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"matek-video-streamer/internal/api"
+	"matek-video-streamer/internal/cluster"
+	"matek-video-streamer/internal/config"
+	"matek-video-streamer/internal/server"
+	"matek-video-streamer/internal/utils"
+	"matek-video-streamer/pkg/source"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/urfave/cli/v2"
+
+	// register the built-in sources, mpegts and rtsp, whatever else this package uses
+	_ "matek-video-streamer/internal/streamer"
+)
+
+// New returns the command line application, which serves the input with the first registered source that matches it
+func New() *cli.App {
+	return &cli.App{
+		Name:  "nebula-video-streamer",
+		Usage: "serve a H264 stream over RTSP",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "config",
+				Usage: "path to a JSON configuration file",
+			},
+			&cli.StringFlag{
+				Name:  "input",
+				Usage: "named pipe or file to read the MPEG-TS stream from, or rtsp:// URL of a camera",
+				Value: config.Default().Input,
+			},
+			&cli.StringFlag{
+				Name:  "path",
+				Usage: "RTSP path the stream is served on",
+			},
+			&cli.BoolFlag{
+				Name:  "substream",
+				Usage: "serve a low resolution copy of the stream on <path>_sub",
+			},
+			&cli.StringFlag{
+				Name:  "rtsp-user",
+				Usage: "username of the RTSP camera",
+			},
+			&cli.StringFlag{
+				Name:  "rtsp-pass",
+				Usage: "password of the RTSP camera",
+			},
+			&cli.StringFlag{
+				Name:  "rtsp-transport",
+				Usage: "transport used to read from the RTSP camera (auto, udp, tcp)",
+			},
+			&cli.StringFlag{
+				Name:  "redis",
+				Usage: "address of the Redis server shared by a fleet of streamers, enables clustering",
+			},
+			&cli.StringFlag{
+				Name:  "public-address",
+				Usage: "host:port other instances redirect clients to",
+			},
+			&cli.StringFlag{
+				Name:  "api-address",
+				Usage: "address of the HTTP API (e.g. :9997), disabled when empty",
+			},
+			&cli.BoolFlag{
+				Name:  "backchannel",
+				Usage: "accept audio from readers through the ONVIF back channel",
+			},
+			&cli.StringFlag{
+				Name:  "backchannel-sink",
+				Usage: "file, named pipe or exec:command that receives back channel audio",
+			},
+			&cli.StringFlag{
+				Name:  "read-user",
+				Usage: "username readers must provide, unless overridden per path",
+			},
+			&cli.StringFlag{
+				Name:  "read-pass",
+				Usage: "password readers must provide, unless overridden per path",
+			},
+		},
+		Action: serve,
+		Commands: []*cli.Command{
+			convertCommand,
+		},
+	}
+}
+
+// loadConfig reads the configuration file, if any, and applies the global flags on top of it
+func loadConfig(c *cli.Context) (*config.Config, error) {
+	conf, err := config.Load(c.String("config"))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.IsSet("input") || conf.Input == "" {
+		conf.Input = c.String("input")
+	}
+	if c.IsSet("path") {
+		conf.Path = c.String("path")
+	}
+	conf.Path = strings.Trim(conf.Path, "/")
+	if c.IsSet("substream") {
+		conf.Substream.Enable = c.Bool("substream")
+	}
+	if c.IsSet("rtsp-user") {
+		conf.RTSP.Username = c.String("rtsp-user")
+	}
+	if c.IsSet("rtsp-pass") {
+		conf.RTSP.Password = c.String("rtsp-pass")
+	}
+	if c.IsSet("rtsp-transport") {
+		conf.RTSP.Transport = c.String("rtsp-transport")
+	}
+	if c.IsSet("redis") {
+		conf.Cluster.Enable = true
+		conf.Cluster.RedisAddress = c.String("redis")
+	}
+	if c.IsSet("public-address") {
+		conf.Cluster.PublicAddress = c.String("public-address")
+	}
+	if c.IsSet("api-address") {
+		conf.APIAddress = c.String("api-address")
+	}
+	if c.IsSet("backchannel") {
+		conf.Backchannel.Enable = c.Bool("backchannel")
+	}
+	if c.IsSet("backchannel-sink") {
+		conf.Backchannel.Sink = c.String("backchannel-sink")
+	}
+	if c.IsSet("read-user") {
+		conf.PathDefaults.ReadUser = c.String("read-user")
+	}
+	if c.IsSet("read-pass") {
+		conf.PathDefaults.ReadPass = c.String("read-pass")
+	}
+
+	return conf, conf.Validate()
+}
+
+func serve(c *cli.Context) error {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	// stop on termination signals, including while waiting for the input
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("received %v, shutting down", sig)
+			ctxCancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	h := &server.ServerHandler{
+		Readers: conf.Readers,
+	}
+
+	cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
+	if err != nil {
+		panic(err)
+	}
+
+	// prevent clients from connecting to the server until the stream is properly set up
+	h.Mutex.Lock()
+
+	// share the paths served by this instance with the rest of the fleet
+	if conf.Cluster.Enable {
+		h.Registry = cluster.NewRegistry(conf.Cluster)
+		err = h.Registry.Initialize()
+		if err != nil {
+			return err
+		}
+		defer h.Registry.Close()
+	}
+
+	// create the server
+	h.Server = &gortsplib.Server{
+		Handler:           h,
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}},
+		RTSPAddress:       "0.0.0.0:8554",
+		UDPRTPAddress:     "0.0.0.0:8000",
+		UDPRTCPAddress:    "0.0.0.0:8001",
+		MulticastIPRange:  "224.1.0.0/16",
+		MulticastRTPPort:  8002,
+		MulticastRTCPPort: 8003,
+		// leave room for the GOP cache, which is sent to new readers at once
+		WriteQueueSize: server.WriteQueueSize,
+	}
+
+	// start the server
+	err = h.Server.Start()
+	if err != nil {
+		panic(err)
+	}
+	defer h.Server.Close()
+
+	// close readers that stop sending keepalives, and say goodbye to the others on shutdown
+	h.Initialize()
+	defer h.Close()
+
+	// find the source that can read the input
+	src, input, err := source.Find(conf.Input)
+	if err != nil {
+		return err
+	}
+	log.Printf("reading %s with the %s source", conf.Input, src.Name)
+
+	// keep the pipe while the server runs, since the streamer reopens it when the writer restarts,
+	// and remove it once the streamer is closed
+	if input.Pipe {
+		defer func() {
+			err := utils.RemovePipe(conf.Input)
+			if err != nil {
+				log.Printf("Warning: Failed to remove pipe file: %v", err)
+			}
+		}()
+	}
+
+	h264Params, err := src.Probe(ctx, conf.Input, conf)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("failed to extract H.264 parameters: %v", err)
+	}
+
+	// create a RTSP description that contains a H264 format
+	desc := newH264Description(h264Params.SPS, h264Params.PPS)
+
+	// add a sendonly audio media that readers can use to talk through the device
+	if conf.Backchannel.Enable {
+		h.Backchannel = &server.Backchannel{Sink: conf.Backchannel.Sink}
+		desc.Medias = append(desc.Medias, h.Backchannel.Media())
+	}
+
+	// create a server stream
+	stream := &gortsplib.ServerStream{
+		Server: h.Server,
+		Desc:   desc,
+	}
+	err = stream.Initialize()
+	if err != nil {
+		panic(err)
+	}
+	defer stream.Close()
+	p := newPath(conf, conf.Path, stream)
+	h.Paths = map[string]*server.Path{
+		conf.Path: p,
+	}
+
+	// create the streamer that reads from the input
+	r, err := src.New(conf.Input, newOutput(p), conf)
+	if err != nil {
+		panic(err)
+	}
+	err = r.Initialize()
+	if err != nil {
+		panic(err)
+	}
+	defer r.Close()
+
+	// allow clients to connect
+	h.Mutex.Unlock()
+	if h.Registry != nil {
+		h.Registry.Register(conf.Path)
+	}
+
+	rec, err := startRecorder(h, conf.Path, p.Conf)
+	if err != nil {
+		log.Printf("Warning: Failed to record /%s: %v", conf.Path, err)
+	} else if rec != nil {
+		defer rec.Close()
+	}
+
+	// expose sessions through the HTTP API
+	if conf.APIAddress != "" {
+		a := &api.API{
+			Address: conf.APIAddress,
+			Handler: h,
+		}
+		err = a.Initialize()
+		if err != nil {
+			panic(err)
+		}
+		defer a.Close()
+	}
+
+	// serve a downscaled copy of the stream
+	if conf.Substream.Enable {
+		var sub *substream
+		sub, err = newSubstream(h, conf)
+		if err != nil {
+			log.Printf("Warning: Failed to start substream: %v", err)
+		} else {
+			defer sub.Close()
+		}
+	}
+
+	// wait until a fatal error or a termination signal
+	log.Printf("server is ready on %s", h.Server.RTSPAddress)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- h.Server.Wait()
+	}()
+
+	select {
+	case err = <-serverErr:
+		panic(err)
+
+	case <-ctx.Done():
+		// say goodbye to readers before streams and sources are closed by deferred calls
+		h.Close()
+		return nil
+	}
+}
+
+// newH264Description returns a RTSP description that contains a H264 format
+func newH264Description(sps []byte, pps []byte) *description.Session {
+	return &description.Session{
+		Medias: []*description.Media{{
+			Type: description.MediaTypeVideo,
+			Formats: []format.Format{&format.H264{
+				PayloadTyp:        96,
+				PacketizationMode: 1,
+				SPS:               sps,
+				PPS:               pps,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,26 @@
+package app
+
+import (
+	"matek-video-streamer/pkg/source"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltinSources(t *testing.T) {
+	for _, ca := range []struct {
+		address string
+		source  string
+	}{
+		{"rtsp://192.168.1.10:554/stream", "rtsp"},
+		{"rtsps://camera.local/stream", "rtsp"},
+		{filepath.Join(t.TempDir(), "video.ts"), "mpegts"},
+	} {
+		s, _, err := source.Find(ca.address)
+		if err != nil {
+			t.Fatalf("%s: %v", ca.address, err)
+		}
+		if s.Name != ca.source {
+			t.Errorf("%s: source = %s, want %s", ca.address, s.Name, ca.source)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"matek-video-streamer/internal/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// convertCommand re-encodes a video file into a MPEG-TS file that can be streamed
+var convertCommand = &cli.Command{
+	Name:      "convert",
+	Usage:     "convert video files to MPEG-TS",
+	ArgsUsage: "INPUT OUTPUT | --output-dir DIR INPUT...",
+	Description: "Converts a single file, or with --output-dir, any number of files and glob patterns\n" +
+		"(e.g. 'archive/*.mp4') in parallel, each one into DIR with a .ts extension.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "output-dir",
+			Usage: "directory the inputs are converted into, enables batch mode",
+		},
+		&cli.IntFlag{
+			Name:    "jobs",
+			Aliases: []string{"j"},
+			Usage:   "number of files converted in parallel in batch mode",
+			Value:   2,
+		},
+		&cli.IntFlag{
+			Name:  "keyint",
+			Usage: "keyframe interval in frames, shorter GOPs lower startup latency but raise bitrate",
+		},
+		&cli.StringFlag{
+			Name:  "bitrate",
+			Usage: "target video bitrate (e.g. 2M)",
+		},
+		&cli.StringFlag{
+			Name:  "preset",
+			Usage: "x264 preset (ultrafast, superfast, veryfast, ...)",
+		},
+		&cli.StringFlag{
+			Name:  "resolution",
+			Usage: "output resolution as WIDTHxHEIGHT",
+		},
+	},
+	Action: convert,
+}
+
+// encoderParams returns the encoder settings of the configuration with the convert flags applied on top
+func encoderParams(c *cli.Context) (utils.EncoderParams, error) {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return utils.EncoderParams{}, err
+	}
+
+	params := conf.Encoder
+	if c.IsSet("keyint") {
+		params.Keyint = c.Int("keyint")
+	}
+	if c.IsSet("bitrate") {
+		params.Bitrate = c.String("bitrate")
+	}
+	if c.IsSet("preset") {
+		params.Preset = c.String("preset")
+	}
+	if c.IsSet("resolution") {
+		params.Resolution = c.String("resolution")
+	}
+
+	return params, params.Validate()
+}
+
+func convert(c *cli.Context) error {
+	if c.IsSet("output-dir") {
+		return convertBatch(c)
+	}
+
+	if c.Args().Len() != 2 {
+		return fmt.Errorf("expected INPUT and OUTPUT arguments, or inputs with --output-dir")
+	}
+
+	params, err := encoderParams(c)
+	if err != nil {
+		return err
+	}
+
+	input, output := c.Args().Get(0), c.Args().Get(1)
+	log.Printf("converting %s to %s (keyint=%d preset=%s)", input, output, params.Keyint, params.Preset)
+
+	err = utils.MP4ToTS(input, output, params)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("conversion done")
+	return nil
+}
+
+// conversion is a file converted in batch mode
+type conversion struct {
+	index  int
+	input  string
+	output string
+
+	// duration of the input, zero when unknown
+	duration time.Duration
+	elapsed  time.Duration
+	err      error
+}
+
+// newConversions expands the glob patterns of the inputs and assigns an output path to each of them
+func newConversions(patterns []string, outputDir string) ([]*conversion, error) {
+	var inputs []string
+	seen := make(map[string]struct{})
+
+	for _, pattern := range patterns {
+		matches := []string{pattern}
+
+		if strings.ContainsAny(pattern, "*?[") {
+			var err error
+			matches, err = filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no file matches %s", pattern)
+			}
+		}
+
+		for _, input := range matches {
+			fi, err := os.Stat(input)
+			if err != nil {
+				return nil, err
+			}
+			if fi.IsDir() {
+				return nil, fmt.Errorf("%s is a directory", input)
+			}
+
+			if _, ok := seen[input]; !ok {
+				seen[input] = struct{}{}
+				inputs = append(inputs, input)
+			}
+		}
+	}
+
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("expected at least one input")
+	}
+
+	convs := make([]*conversion, len(inputs))
+	outputs := make(map[string]string)
+
+	for i, input := range inputs {
+		base := filepath.Base(input)
+		output := filepath.Join(outputDir, strings.TrimSuffix(base, filepath.Ext(base))+".ts")
+
+		if other, ok := outputs[output]; ok {
+			return nil, fmt.Errorf("%s and %s would both be converted into %s", other, input, output)
+		}
+		if absPath(output) == absPath(input) {
+			return nil, fmt.Errorf("%s would be overwritten by its own conversion", input)
+		}
+		outputs[output] = input
+
+		convs[i] = &conversion{
+			index:  i + 1,
+			input:  input,
+			output: output,
+		}
+	}
+
+	return convs, nil
+}
+
+func absPath(path string) string {
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return p
+}
+
+// run converts the file and logs its progress every 10%
+func (conv *conversion) run(params utils.EncoderParams, total int) {
+	start := time.Now()
+	name := fmt.Sprintf("[%d/%d] %s", conv.index, total, filepath.Base(conv.input))
+
+	// the duration is only needed to report progress
+	var err error
+	conv.duration, err = utils.MediaDuration(conv.input)
+	if err != nil {
+		log.Printf("%s: unknown duration, progress will not be reported: %v", name, err)
+	}
+
+	log.Printf("%s: converting to %s", name, conv.output)
+
+	// write into a temporary file next to the output, so that a failed conversion
+	// never replaces the output of an earlier run
+	tmp := filepath.Join(filepath.Dir(conv.output), "."+filepath.Base(conv.output)+".tmp")
+
+	lastStep := 0
+	conv.err = utils.MP4ToTSWithProgress(conv.input, tmp, params, func(pos time.Duration) {
+		if conv.duration <= 0 {
+			return
+		}
+
+		step := int(pos * 10 / conv.duration)
+		if step > lastStep && step < 10 {
+			lastStep = step
+			log.Printf("%s: %d%%", name, step*10)
+		}
+	})
+	if conv.err == nil {
+		conv.err = os.Rename(tmp, conv.output)
+	}
+	conv.elapsed = time.Since(start)
+
+	if conv.err != nil {
+		// do not leave truncated files behind
+		os.Remove(tmp)
+		log.Printf("%s: failed: %v", name, conv.err)
+		return
+	}
+
+	log.Printf("%s: done in %v", name, conv.elapsed.Round(time.Second))
+}
+
+// convertBatch converts multiple files with a pool of workers and prints a summary report
+func convertBatch(c *cli.Context) error {
+	params, err := encoderParams(c)
+	if err != nil {
+		return err
+	}
+
+	workers := c.Int("jobs")
+	if workers < 1 {
+		return fmt.Errorf("jobs must be at least 1")
+	}
+
+	outputDir := c.String("output-dir")
+	convs, err := newConversions(c.Args().Slice(), outputDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(outputDir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	workers = min(workers, len(convs))
+	log.Printf("converting %d files with %d workers (keyint=%d preset=%s)", len(convs), workers, params.Keyint, params.Preset)
+
+	start := time.Now()
+	queue := make(chan *conversion)
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for conv := range queue {
+				conv.run(params, len(convs))
+			}
+		}()
+	}
+
+	for _, conv := range convs {
+		queue <- conv
+	}
+	close(queue)
+	wg.Wait()
+
+	return printSummary(convs, time.Since(start))
+}
+
+// printSummary prints the outcome of each conversion, and returns an error if any of them failed
+func printSummary(convs []*conversion, elapsed time.Duration) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tINPUT\tOUTPUT\tDURATION\tTIME\tERROR")
+
+	failed := 0
+	for _, conv := range convs {
+		status, errMsg := "ok", ""
+		if conv.err != nil {
+			status, errMsg = "failed", firstLine(conv.err)
+			failed++
+		}
+
+		duration := "-"
+		if conv.duration > 0 {
+			duration = conv.duration.Round(time.Second).String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			status, conv.input, conv.output, duration, conv.elapsed.Round(time.Second), errMsg)
+	}
+	w.Flush()
+
+	fmt.Printf("converted %d of %d files in %v\n", len(convs)-failed, len(convs), elapsed.Round(time.Second))
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d conversions failed", failed, len(convs))
+	}
+	return nil
+}
+
+// firstLine returns the first line of an error, FFmpeg errors include the whole FFmpeg output
+func firstLine(err error) string {
+	msg, _, _ := strings.Cut(err.Error(), "\n")
+	return msg
+}
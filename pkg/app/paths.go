@@ -0,0 +1,93 @@
+package app
+
+import (
+	"log"
+	"matek-video-streamer/internal/config"
+	"matek-video-streamer/internal/server"
+	"matek-video-streamer/internal/utils"
+	"matek-video-streamer/pkg/source"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+)
+
+// newPath returns a path that serves a stream with the policies set in the configuration
+func newPath(conf *config.Config, name string, stream *gortsplib.ServerStream) *server.Path {
+	p := &server.Path{
+		Stream: stream,
+		Conf:   conf.PathConf(name),
+	}
+	if p.Conf.UseGOPCache() {
+		p.GOPCache = &server.GOPCache{}
+	}
+	return p
+}
+
+// newOutput returns the output sources write the stream of a path to
+func newOutput(p *server.Path) *source.Output {
+	out := &source.Output{Stream: p.Stream}
+	// a nil *GOPCache stored into the interface would not be nil
+	if p.GOPCache != nil {
+		out.Cache = p.GOPCache
+	}
+	return out
+}
+
+// localURL returns the URL processes running next to the server can read a path from,
+// including the credentials of the path
+func localURL(h *server.ServerHandler, name string, pathConf config.PathConfig) (string, error) {
+	_, port, err := net.SplitHostPort(h.Server.RTSPAddress)
+	if err != nil {
+		return "", err
+	}
+
+	u := &url.URL{
+		Scheme: "rtsp",
+		Host:   "127.0.0.1:" + port,
+		Path:   "/" + name,
+	}
+	if h.Server.TLSConfig != nil {
+		u.Scheme = "rtsps"
+	}
+	if pathConf.ReadUser != "" {
+		u.User = url.UserPassword(pathConf.ReadUser, pathConf.ReadPass)
+	}
+
+	return u.String(), nil
+}
+
+// startRecorder starts recording a path, if enabled in its policies. It returns nil when disabled.
+func startRecorder(h *server.ServerHandler, name string, pathConf config.PathConfig) (*utils.Recorder, error) {
+	if !pathConf.Record {
+		return nil, nil
+	}
+
+	sourceURL, err := localURL(h, name, pathConf)
+	if err != nil {
+		return nil, err
+	}
+
+	// the root path has no name to prefix segments with
+	prefix := strings.ReplaceAll(name, "/", "_")
+	if prefix == "" {
+		prefix = "stream"
+	}
+
+	rec := &utils.Recorder{
+		Source:          sourceURL,
+		Dir:             pathConf.RecordDir,
+		Name:            prefix,
+		SegmentDuration: time.Duration(pathConf.RecordSegmentDuration),
+	}
+	err = rec.Initialize()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("recording /%s into %s", name, pathConf.RecordDir)
+
+	return rec, nil
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"log"
+	"matek-video-streamer/internal/config"
+	"matek-video-streamer/internal/server"
+	"matek-video-streamer/internal/streamer"
+	"matek-video-streamer/internal/utils"
+	"matek-video-streamer/pkg/source"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+)
+
+// substream is a downscaled copy of the main stream, produced by a managed FFmpeg
+// process that reads the main stream from this server and writes into a named pipe.
+type substream struct {
+	h          *server.ServerHandler
+	path       string
+	pipeName   string
+	transcoder *utils.Transcoder
+	recorder   *utils.Recorder
+	stream     *gortsplib.ServerStream
+	r          source.Streamer
+}
+
+func newSubstream(h *server.ServerHandler, conf *config.Config) (*substream, error) {
+	s := &substream{
+		h:    h,
+		path: config.SubstreamPath(conf.Path),
+	}
+	s.pipeName = filepath.Join(os.TempDir(), "substream_"+strings.ReplaceAll(s.path, "/", "_"))
+
+	err := utils.CreatePipe(s.pipeName)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the main stream back from the server
+	sourceURL, err := localURL(h, conf.Path, conf.PathConf(conf.Path))
+	if err != nil {
+		utils.RemovePipe(s.pipeName)
+		return nil, err
+	}
+
+	s.transcoder = &utils.Transcoder{
+		Source: sourceURL,
+		Output: s.pipeName,
+		Params: conf.Substream.EncoderParams(),
+		FPS:    conf.Substream.FPS,
+	}
+	err = s.transcoder.Initialize()
+	if err != nil {
+		utils.RemovePipe(s.pipeName)
+		return nil, err
+	}
+
+	h264Params, err := utils.ExtractH264ParametersFromPipe(s.pipeName, 30*time.Second)
+	if err != nil {
+		s.transcoder.Close()
+		utils.RemovePipe(s.pipeName)
+		return nil, err
+	}
+
+	s.stream = &gortsplib.ServerStream{
+		Server: h.Server,
+		Desc:   newH264Description(h264Params.SPS, h264Params.PPS),
+	}
+	err = s.stream.Initialize()
+	if err != nil {
+		s.transcoder.Close()
+		utils.RemovePipe(s.pipeName)
+		return nil, err
+	}
+
+	p := newPath(conf, s.path, s.stream)
+
+	s.r = streamer.New(newOutput(p), s.pipeName)
+	err = s.r.Initialize()
+	if err != nil {
+		s.stream.Close()
+		s.transcoder.Close()
+		utils.RemovePipe(s.pipeName)
+		return nil, err
+	}
+
+	h.Mutex.Lock()
+	h.Paths[s.path] = p
+	h.Mutex.Unlock()
+	if h.Registry != nil {
+		h.Registry.Register(s.path)
+	}
+
+	s.recorder, err = startRecorder(h, s.path, p.Conf)
+	if err != nil {
+		log.Printf("Warning: Failed to record /%s: %v", s.path, err)
+	}
+
+	log.Printf("substream is ready on /%s (%s@%dfps)", s.path, conf.Substream.Resolution, conf.Substream.FPS)
+
+	return s, nil
+}
+
+func (s *substream) Close() {
+	if s.h.Registry != nil {
+		s.h.Registry.Unregister(s.path)
+	}
+	s.h.Mutex.Lock()
+	delete(s.h.Paths, s.path)
+	s.h.Mutex.Unlock()
+
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+
+	s.transcoder.Close()
+	s.r.Close()
+	s.stream.Close()
+	utils.RemovePipe(s.pipeName)
+}
@@ -0,0 +1,226 @@
+// Package source contains the registry of the input types the streamer can read from.
+// Programs embedding the streamer can register their own sources.
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/pion/rtp"
+)
+
+// sniffSize is the number of bytes of regular files passed to content matchers
+const sniffSize = 1024
+
+// Input describes an input, as seen by matchers
+type Input struct {
+	// Address is the input as given by the user
+	Address string
+	// Scheme is the lowercase URL scheme of the address, empty for files
+	Scheme string
+	// Header holds the first bytes of regular files, nil for other inputs.
+	// Named pipes are never read, since their content can't be read twice.
+	Header []byte
+	// Pipe is true when the address is a named pipe
+	Pipe bool
+}
+
+// Matcher returns whether an input can be read by a source
+type Matcher func(in *Input) bool
+
+// MatchScheme matches URLs with one of the given schemes
+func MatchScheme(schemes ...string) Matcher {
+	return func(in *Input) bool {
+		return slices.Contains(schemes, in.Scheme)
+	}
+}
+
+// MatchExtension matches files with one of the given extensions, such as ".ts"
+func MatchExtension(exts ...string) Matcher {
+	return func(in *Input) bool {
+		return in.Scheme == "" && slices.Contains(exts, strings.ToLower(filepath.Ext(in.Address)))
+	}
+}
+
+// MatchContent matches regular files whose first bytes are accepted by sniff
+func MatchContent(sniff func(header []byte) bool) Matcher {
+	return func(in *Input) bool {
+		return in.Header != nil && sniff(in.Header)
+	}
+}
+
+// MatchNamedPipe matches named pipes
+func MatchNamedPipe() Matcher {
+	return func(in *Input) bool {
+		return in.Pipe
+	}
+}
+
+// Parameters holds the H264 parameters of an input
+type Parameters struct {
+	SPS []byte
+	PPS []byte
+}
+
+// Settings gives sources access to the configuration of the streamer
+type Settings interface {
+	// Decode unmarshals the configuration into v, as if v was the target of the JSON
+	// configuration file. Settings of embedded sources can be placed under "sources".
+	Decode(v any) error
+}
+
+// Cache stores the packets new readers receive before live ones. Packets are stored
+// and sent to readers while the cache is locked, so that a reader can join from
+// the cache without missing packets or receiving them twice.
+type Cache interface {
+	sync.Locker
+	// Write stores packets. It is called with the cache locked.
+	Write(packets []*rtp.Packet, randomAccess bool)
+}
+
+// Output is the stream a source writes to
+type Output struct {
+	Stream *gortsplib.ServerStream
+	// Cache receives the written packets, when not nil
+	Cache Cache
+}
+
+// WritePackets sends the RTP packets of an access unit, or of a part of it, to the readers of the stream.
+// Packets are stored into the cache and sent to readers in a single step, under the lock of the cache.
+// randomAccess must be true when the packets start an access unit decoding can start from.
+func (o *Output) WritePackets(packets []*rtp.Packet, randomAccess bool) error {
+	if o.Cache != nil {
+		o.Cache.Lock()
+		defer o.Cache.Unlock()
+
+		o.Cache.Write(packets, randomAccess)
+	}
+
+	for _, packet := range packets {
+		err := o.Stream.WritePacketRTP(o.Stream.Desc.Medias[0], packet)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Streamer routes frames from an input to an Output
+type Streamer interface {
+	Initialize() error
+	Close()
+}
+
+// Source is an input type the streamer can read from
+type Source struct {
+	// Name identifies the source in logs
+	Name string
+	// Matchers select the inputs handled by the source. Any of them must match.
+	Matchers []Matcher
+	// Probe returns the H264 parameters of an input, which are needed to describe the stream.
+	// It must return when ctx is canceled.
+	Probe func(ctx context.Context, address string, settings Settings) (*Parameters, error)
+	// New returns a streamer that routes frames from an input to out
+	New func(address string, out *Output, settings Settings) (Streamer, error)
+}
+
+func (s *Source) match(in *Input) bool {
+	for _, m := range s.Matchers {
+		if m(in) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	sourcesMutex sync.RWMutex
+	sources      []*Source
+)
+
+// Register adds a source to the registry. It is meant to be called from init functions,
+// including the ones of packages embedding the streamer.
+// Sources are tried in registration order, the first matching one is used.
+func Register(s *Source) {
+	if s.Name == "" || len(s.Matchers) == 0 || s.Probe == nil || s.New == nil {
+		panic("source: incomplete source " + s.Name)
+	}
+
+	sourcesMutex.Lock()
+	defer sourcesMutex.Unlock()
+
+	for _, existing := range sources {
+		if existing.Name == s.Name {
+			panic("source: registered twice: " + s.Name)
+		}
+	}
+	sources = append(sources, s)
+}
+
+// Find returns the source that can read an input, together with the description of the input
+func Find(address string) (*Source, *Input, error) {
+	in, err := describeInput(address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sourcesMutex.RLock()
+	defer sourcesMutex.RUnlock()
+
+	for _, s := range sources {
+		if s.match(in) {
+			return s, in, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("no source can read %s", address)
+}
+
+func describeInput(address string) (*Input, error) {
+	in := &Input{Address: address}
+
+	// Windows-like paths such as C:\video.ts are not URLs
+	if u, err := url.Parse(address); err == nil && len(u.Scheme) > 1 {
+		in.Scheme = strings.ToLower(u.Scheme)
+		return in, nil
+	}
+
+	fi, err := os.Stat(address)
+	if err != nil {
+		// devices and files that are created later can still be matched by name
+		if os.IsNotExist(err) {
+			return in, nil
+		}
+		return nil, err
+	}
+
+	switch {
+	case fi.Mode()&os.ModeNamedPipe != 0:
+		in.Pipe = true
+
+	case fi.Mode().IsRegular():
+		f, err := os.Open(address)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		header := make([]byte, sniffSize)
+		n, err := io.ReadFull(f, header)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		in.Header = header[:n]
+	}
+
+	return in, nil
+}